@@ -0,0 +1,65 @@
+// Package auth resolves the sha256(password) sent by AnyTLS clients to users.
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// User is the identity a password hash belongs to
+type User struct {
+	// ID identifies the user in traffic accounting and session management.
+	// Fixed passwords all map to user 0.
+	ID   int
+	Name string
+}
+
+// Credential is a user with its plain text password, for sharing with clients
+type Credential struct {
+	User
+	Password string
+}
+
+// Authenticator checks the 32-byte sha256(password) sent by a client
+type Authenticator interface {
+	Authenticate(passwordSha256 []byte) (user User, ok bool)
+}
+
+// Revoker is implemented by authenticators whose users can become invalid
+// while they are connected, e.g. when removed from a panel or over quota.
+type Revoker interface {
+	// OnUsersRemoved sets the hook called with the IDs of such users
+	OnUsersRemoved(hook func(userIDs []int))
+}
+
+// TrafficRecorder is implemented by authenticators that account traffic per user
+type TrafficRecorder interface {
+	RecordTraffic(userID int, upload, download int64)
+}
+
+// Passwords accepts a fixed set of passwords as user 0
+type Passwords struct {
+	sums [][sha256.Size]byte
+}
+
+func NewPasswords(passwords ...string) *Passwords {
+	p := &Passwords{}
+	for _, password := range passwords {
+		p.sums = append(p.sums, sha256.Sum256([]byte(password)))
+	}
+	return p
+}
+
+func (p *Passwords) Authenticate(passwordSha256 []byte) (User, bool) {
+	for _, sum := range p.sums {
+		if subtle.ConstantTimeCompare(passwordSha256, sum[:]) == 1 {
+			return User{}, true
+		}
+	}
+	return User{}, false
+}
+
+// UserCount returns the number of passwords
+func (p *Passwords) UserCount() int {
+	return len(p.sums)
+}
@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileAuthenticator authenticates the users listed in a text file, one per line:
+//
+//	# name password [quota]
+//	alice  s3cret   100GiB
+//	bob    hunter2
+//
+// The quota limits upload plus download, in bytes or with a B, KB, MB, GB, TB
+// (powers of 1000) or KiB, MiB, GiB, TiB (powers of 1024) suffix; 0 or no quota
+// is unlimited. Usage is kept in memory and starts from zero when the process
+// starts. A user ID stays the same across reloads as long as the name does.
+type FileAuthenticator struct {
+	path string
+
+	// mu protects the maps, stamp and nextID
+	mu     sync.RWMutex
+	byHash map[[sha256.Size]byte]*fileUser
+	byName map[string]*fileUser
+	byID   map[int]*fileUser
+	stamp  fileStamp
+	nextID int
+
+	onUsersRemoved func(userIDs []int)
+}
+
+type fileUser struct {
+	User
+	password string
+	hash     [sha256.Size]byte
+	quota    int64
+	// used is shared by the old and new entry of a user across reloads
+	used *atomic.Int64
+}
+
+func (u *fileUser) overQuota() bool {
+	return u.quota > 0 && u.used.Load() >= u.quota
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewFileAuthenticator loads the users file, failing on any invalid line
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	a := &FileAuthenticator{
+		path:   path,
+		byHash: make(map[[sha256.Size]byte]*fileUser),
+		byName: make(map[string]*fileUser),
+		byID:   make(map[int]*fileUser),
+		nextID: 1,
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// OnUsersRemoved sets the hook called with users that were removed from the
+// file, changed their password or ran out of quota. Set it before Reload runs again.
+func (a *FileAuthenticator) OnUsersRemoved(hook func(userIDs []int)) {
+	a.onUsersRemoved = hook
+}
+
+func (a *FileAuthenticator) Authenticate(passwordSha256 []byte) (User, bool) {
+	if len(passwordSha256) != sha256.Size {
+		return User{}, false
+	}
+	a.mu.RLock()
+	u, exists := a.byHash[[sha256.Size]byte(passwordSha256)]
+	a.mu.RUnlock()
+	if !exists || u.overQuota() {
+		return User{}, false
+	}
+	return u.User, true
+}
+
+// RecordTraffic adds to the usage of a user and revokes it once over quota
+func (a *FileAuthenticator) RecordTraffic(userID int, upload, download int64) {
+	a.mu.RLock()
+	user, exists := a.byID[userID]
+	a.mu.RUnlock()
+	if !exists {
+		return
+	}
+	before := user.used.Add(upload+download) - upload - download
+	if user.quota > 0 && before < user.quota && user.overQuota() {
+		logrus.Infoln("[Auth] user", user.Name, "is over quota")
+		if a.onUsersRemoved != nil {
+			a.onUsersRemoved([]int{userID})
+		}
+	}
+}
+
+// UserCount returns the number of users in the file
+func (a *FileAuthenticator) UserCount() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.byName)
+}
+
+// Credentials returns the users with their passwords, ordered by ID
+func (a *FileAuthenticator) Credentials() []Credential {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	credentials := make([]Credential, 0, len(a.byID))
+	for _, u := range a.byID {
+		credentials = append(credentials, Credential{User: u.User, Password: u.password})
+	}
+	slices.SortFunc(credentials, func(a, b Credential) int {
+		return a.ID - b.ID
+	})
+	return credentials
+}
+
+// CheckModified reloads the file when its modification time or size changed.
+// A file that fails to load leaves the current users in place.
+func (a *FileAuthenticator) CheckModified() {
+	stamp, err := statFile(a.path)
+	if err != nil {
+		logrus.Warnln("[Auth] stat users file:", err)
+		return
+	}
+	a.mu.RLock()
+	changed := stamp != a.stamp
+	a.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := a.Reload(); err != nil {
+		logrus.Errorln("[Auth] reload users file (keeping the current users):", err)
+		return
+	}
+	logrus.Infoln("[Auth] users file reloaded:", a.path)
+}
+
+// Reload reads the file again and revokes users that were removed, changed
+// their password or are now over quota
+func (a *FileAuthenticator) Reload() error {
+	stamp, err := statFile(a.path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseUsersFile(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+
+	a.mu.Lock()
+	byHash := make(map[[sha256.Size]byte]*fileUser, len(users))
+	byName := make(map[string]*fileUser, len(users))
+	byID := make(map[int]*fileUser, len(users))
+	var removed []int
+	for _, u := range users {
+		if old, exists := a.byName[u.Name]; exists {
+			u.ID = old.ID
+			u.used = old.used
+			if old.hash != u.hash {
+				removed = append(removed, u.ID)
+			}
+		} else {
+			u.ID = a.nextID
+			a.nextID++
+			u.used = new(atomic.Int64)
+		}
+		if u.overQuota() {
+			removed = append(removed, u.ID)
+		}
+		byHash[u.hash] = u
+		byName[u.Name] = u
+		byID[u.ID] = u
+	}
+	for name, old := range a.byName {
+		if _, exists := byName[name]; !exists {
+			removed = append(removed, old.ID)
+		}
+	}
+	a.byHash = byHash
+	a.byName = byName
+	a.byID = byID
+	a.stamp = stamp
+	a.mu.Unlock()
+
+	if len(removed) > 0 && a.onUsersRemoved != nil {
+		a.onUsersRemoved(removed)
+	}
+	return nil
+}
+
+func parseUsersFile(content []byte) ([]*fileUser, error) {
+	var users []*fileUser
+	names := make(map[string]int)
+	hashes := make(map[[sha256.Size]byte]int)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected name, password and an optional quota", lineNo)
+		}
+		u := &fileUser{
+			User:     User{Name: fields[0]},
+			password: fields[1],
+			hash:     sha256.Sum256([]byte(fields[1])),
+		}
+		if len(fields) == 3 {
+			quota, err := parseSize(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: quota: %w", lineNo, err)
+			}
+			u.quota = quota
+		}
+		if prev, exists := names[u.Name]; exists {
+			return nil, fmt.Errorf("line %d: user %s is already defined on line %d", lineNo, u.Name, prev)
+		}
+		if prev, exists := hashes[u.hash]; exists {
+			return nil, fmt.Errorf("line %d: password is already used on line %d", lineNo, prev)
+		}
+		names[u.Name] = lineNo
+		hashes[u.hash] = lineNo
+		users = append(users, u)
+	}
+	return users, scanner.Err()
+}
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseSize parses a byte size such as 1024, 500MB or 100GiB
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	number := s
+	for _, u := range sizeUnits {
+		if n, found := strings.CutSuffix(s, u.suffix); found {
+			number, unit = n, u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	// NaN fails every comparison, so it is rejected by the range check too
+	size := n * float64(unit)
+	if err != nil || !(size >= 0 && size < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(size), nil
+}
+
+func statFile(name string) (fileStamp, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"10B", 10, false},
+		{"500MB", 500e6, false},
+		{"1.5KB", 1500, false},
+		{"100GiB", 100 << 30, false},
+		{"2TiB", 2 << 40, false},
+		{"1TB", 1e12, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1", 0, true},
+		{"-1GiB", 0, true},
+		{"10XB", 0, true},
+		{"NaN", 0, true},
+		{"NaNGB", 0, true},
+		{"Inf", 0, true},
+		{"+InfTiB", 0, true},
+		{"1e300", 0, true},
+		{"9223372036854775807", 0, true},
+		{"8388608TiB", 0, true},
+		{"8388607TiB", 8388607 << 40, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, error %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseUsersFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []fileUser
+		wantErr string
+	}{
+		{
+			name: "users with and without quota",
+			content: strings.Join([]string{
+				"# name password [quota]",
+				"",
+				"alice  s3cret   100GiB",
+				"  bob\thunter2  ",
+			}, "\n"),
+			want: []fileUser{
+				{User: User{Name: "alice"}, password: "s3cret", quota: 100 << 30},
+				{User: User{Name: "bob"}, password: "hunter2"},
+			},
+		},
+		{name: "empty", content: "# nobody\n"},
+		{name: "missing password", content: "alice", wantErr: "line 1: expected name"},
+		{name: "extra field", content: "alice a 1GB x", wantErr: "line 1: expected name"},
+		{name: "invalid quota", content: "\nalice a lots", wantErr: "line 2: quota"},
+		{name: "duplicate name", content: "alice a\nalice b", wantErr: "line 2: user alice is already defined on line 1"},
+		{name: "duplicate password", content: "alice a\nbob a", wantErr: "line 2: password is already used on line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := parseUsersFile([]byte(tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != len(tt.want) {
+				t.Fatalf("%d users, want %d", len(users), len(tt.want))
+			}
+			for i, u := range users {
+				want := tt.want[i]
+				if u.Name != want.Name || u.password != want.password || u.quota != want.quota {
+					t.Errorf("user %d = %s %s %d, want %s %s %d", i, u.Name, u.password, u.quota, want.Name, want.password, want.quota)
+				}
+				if u.hash != sha256.Sum256([]byte(want.password)) {
+					t.Errorf("user %d: hash is not sha256 of the password", i)
+				}
+			}
+		})
+	}
+}
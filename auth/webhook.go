@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	webhookTimeout      = 5 * time.Second
+	webhookMaxCacheSize = 10000
+)
+
+// WebhookAuthenticator asks an HTTP endpoint about every password hash it
+// has not seen within the cache TTL. The request is
+//
+//	POST <url>
+//	Authorization: Bearer <token>
+//	{"password_sha256": "<hex>"}
+//
+// A 200 response with {"id": 1, "name": "alice"} accepts the client, 401, 403
+// and 404 reject it. Answers are cached for the TTL, other statuses and
+// network errors reject the client without being cached. Concurrent lookups
+// of the same hash share one request.
+type WebhookAuthenticator struct {
+	url    string
+	token  string
+	ttl    time.Duration
+	client *http.Client
+
+	mu       sync.Mutex
+	cache    map[[sha256.Size]byte]*list.Element
+	inflight map[[sha256.Size]byte]*webhookCall
+	// accepted and rejected hold the cached entries in the order they were
+	// stored, which with a single TTL is the order they expire in
+	accepted, rejected list.List
+}
+
+type webhookResult struct {
+	user    User
+	ok      bool
+	expires time.Time
+}
+
+// webhookEntry is the value of the list elements in the cache
+type webhookEntry struct {
+	key [sha256.Size]byte
+	webhookResult
+}
+
+// webhookCall is a query in progress, done is closed once the result is set
+type webhookCall struct {
+	done chan struct{}
+	user User
+	ok   bool
+	err  error
+}
+
+type webhookRequest struct {
+	PasswordSha256 string `json:"password_sha256"`
+}
+
+type webhookResponse struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// NewWebhookAuthenticator creates a WebhookAuthenticator, token may be empty
+// and a zero cacheTTL disables the cache
+func NewWebhookAuthenticator(url, token string, cacheTTL time.Duration) *WebhookAuthenticator {
+	return &WebhookAuthenticator{
+		url:      url,
+		token:    token,
+		ttl:      cacheTTL,
+		client:   &http.Client{Timeout: webhookTimeout},
+		cache:    make(map[[sha256.Size]byte]*list.Element),
+		inflight: make(map[[sha256.Size]byte]*webhookCall),
+	}
+}
+
+func (a *WebhookAuthenticator) Authenticate(passwordSha256 []byte) (User, bool) {
+	if len(passwordSha256) != sha256.Size {
+		return User{}, false
+	}
+	key := [sha256.Size]byte(passwordSha256)
+	now := time.Now()
+
+	a.mu.Lock()
+	if e, exists := a.cache[key]; exists {
+		if r := e.Value.(*webhookEntry); now.Before(r.expires) {
+			a.mu.Unlock()
+			return r.user, r.ok
+		}
+	}
+	if call, exists := a.inflight[key]; exists {
+		a.mu.Unlock()
+		<-call.done
+		return call.user, call.ok && call.err == nil
+	}
+	call := &webhookCall{done: make(chan struct{})}
+	a.inflight[key] = call
+	a.mu.Unlock()
+
+	call.user, call.ok, call.err = a.query(passwordSha256)
+	if call.err != nil {
+		logrus.Warnln("[Auth] webhook:", call.err)
+	}
+
+	a.mu.Lock()
+	delete(a.inflight, key)
+	if call.err == nil && a.ttl > 0 {
+		a.store(key, webhookResult{user: call.user, ok: call.ok, expires: now.Add(a.ttl)}, now)
+	}
+	a.mu.Unlock()
+	close(call.done)
+
+	return call.user, call.ok && call.err == nil
+}
+
+// store caches r, a.mu must be held. When the cache is full, the expired
+// entries at the front of the lists are dropped first, then the oldest
+// rejection and only without rejections the oldest accepted user, so that a
+// flood of wrong passwords does not evict valid users.
+func (a *WebhookAuthenticator) store(key [sha256.Size]byte, r webhookResult, now time.Time) {
+	if e, exists := a.cache[key]; exists {
+		a.remove(e)
+	}
+	if len(a.cache) >= webhookMaxCacheSize {
+		for _, l := range []*list.List{&a.rejected, &a.accepted} {
+			for e := l.Front(); e != nil && !now.Before(e.Value.(*webhookEntry).expires); e = l.Front() {
+				a.remove(e)
+			}
+		}
+		if len(a.cache) >= webhookMaxCacheSize {
+			if e := a.rejected.Front(); e != nil {
+				a.remove(e)
+			} else {
+				a.remove(a.accepted.Front())
+			}
+		}
+	}
+	l := &a.accepted
+	if !r.ok {
+		l = &a.rejected
+	}
+	a.cache[key] = l.PushBack(&webhookEntry{key: key, webhookResult: r})
+}
+
+// remove drops a cached entry, a.mu must be held
+func (a *WebhookAuthenticator) remove(e *list.Element) {
+	entry := e.Value.(*webhookEntry)
+	if entry.ok {
+		a.accepted.Remove(e)
+	} else {
+		a.rejected.Remove(e)
+	}
+	delete(a.cache, entry.key)
+}
+
+func (a *WebhookAuthenticator) query(passwordSha256 []byte) (User, bool, error) {
+	body, err := json.Marshal(webhookRequest{PasswordSha256: hex.EncodeToString(passwordSha256)})
+	if err != nil {
+		return User{}, false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return User{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return User{}, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var r webhookResponse
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&r); err != nil {
+			return User{}, false, err
+		}
+		return User{ID: r.ID, Name: r.Name}, true, nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return User{}, false, nil
+	default:
+		return User{}, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookConcurrentLookups(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Write([]byte(`{"id": 7, "name": "alice"}`))
+	}))
+	defer ts.Close()
+
+	a := NewWebhookAuthenticator(ts.URL, "", 0)
+	hash := sha256.Sum256([]byte("password"))
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if user, ok := a.Authenticate(hash[:]); !ok || user.ID != 7 {
+				t.Errorf("Authenticate() = %v, %v", user, ok)
+			}
+		}()
+	}
+	// let every lookup reach the in-flight request before answering it
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests for one hash, want 1", n)
+	}
+}
+
+func TestWebhookCacheEviction(t *testing.T) {
+	a := NewWebhookAuthenticator("http://127.0.0.1:0", "", time.Hour)
+	now := time.Now()
+	key := func(i int) [sha256.Size]byte {
+		return sha256.Sum256([]byte{byte(i), byte(i >> 8), byte(i >> 16)})
+	}
+
+	// half accepted users, half rejected passwords
+	for i := range webhookMaxCacheSize {
+		a.store(key(i), webhookResult{ok: i%2 == 0, expires: now.Add(time.Hour + time.Duration(i))}, now)
+	}
+	a.store(key(webhookMaxCacheSize), webhookResult{ok: false, expires: now.Add(time.Hour)}, now)
+	for i := 0; i < webhookMaxCacheSize; i += 2 {
+		if _, ok := a.cache[key(i)]; !ok {
+			t.Fatalf("accepted user %d was evicted while rejections were cached", i)
+		}
+	}
+	if _, ok := a.cache[key(1)]; ok {
+		t.Error("rejection survived a full cache")
+	}
+
+	// only accepted users left: the one expiring first goes
+	a = NewWebhookAuthenticator("http://127.0.0.1:0", "", time.Hour)
+	for i := range webhookMaxCacheSize {
+		a.store(key(i), webhookResult{ok: true, expires: now.Add(time.Hour + time.Duration(i))}, now)
+	}
+	a.store(key(webhookMaxCacheSize), webhookResult{ok: true, expires: now.Add(2 * time.Hour)}, now)
+	if len(a.cache) != webhookMaxCacheSize {
+		t.Errorf("cache holds %d entries, want %d", len(a.cache), webhookMaxCacheSize)
+	}
+	if _, ok := a.cache[key(0)]; ok {
+		t.Error("the entry expiring first was kept")
+	}
+	if _, ok := a.cache[key(1)]; !ok {
+		t.Error("an entry other than the one expiring first was evicted")
+	}
+
+	// expired entries go before any valid one
+	later := now.Add(time.Hour + webhookMaxCacheSize/2)
+	a.store(key(webhookMaxCacheSize+1), webhookResult{ok: false, expires: later.Add(time.Hour)}, later)
+	if len(a.cache) != webhookMaxCacheSize/2+1 {
+		t.Errorf("cache holds %d entries after the first half expired", len(a.cache))
+	}
+	if _, ok := a.cache[key(webhookMaxCacheSize)]; !ok {
+		t.Error("an entry that had not expired was evicted")
+	}
+}
@@ -0,0 +1,224 @@
+package anytls
+
+import (
+	"anytls/proxy"
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/uot"
+)
+
+// ClientConfig configures a Client. Zero values use the defaults noted below.
+type ClientConfig struct {
+	// Server is the host:port of the AnyTLS server
+	Server   string
+	Password string
+	// TLSConfig is used for the connections to the server. When nil, the
+	// server certificate is verified against the host of Server.
+	TLSConfig *tls.Config
+	// Dial opens the TCP connection to the server, proxy.SystemDialer by default
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Padding is the initial padding scheme, padding.DefaultPaddingFactory by default.
+	// A scheme pushed by the server only replaces the Client's own copy.
+	Padding *atomic.TypedValue[*padding.PaddingFactory]
+
+	// IdleSessionCheckInterval and IdleSessionTimeout control the session pool, 30s by default
+	IdleSessionCheckInterval time.Duration
+	IdleSessionTimeout       time.Duration
+	// MinIdleSession idle sessions are kept open even when they time out
+	MinIdleSession int
+
+	// HeartbeatInterval enables active keepalive of sessions silent for that long,
+	// sessions not answering within HeartbeatTimeout are closed
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// HealthHook is told about sessions that could not be dialed and whether
+	// cmdSYNACK arrived in time, see session.Client.SetHealthHook
+	HealthHook func(err error)
+}
+
+// Client opens proxied connections through one AnyTLS server
+type Client struct {
+	config         ClientConfig
+	tlsConfig      *tls.Config
+	passwordSha256 []byte
+	sessionClient  *session.Client
+}
+
+// NewClient creates a Client. Sessions are only dialed when needed and are
+// closed with Close or when ctx is done.
+func NewClient(ctx context.Context, config ClientConfig) (*Client, error) {
+	if config.Server == "" {
+		return nil, errors.New("anytls: server address is required")
+	}
+	host, _, err := net.SplitHostPort(config.Server)
+	if err != nil {
+		return nil, err
+	}
+	if config.Password == "" {
+		return nil, errors.New("anytls: password is required")
+	}
+	if config.Dial == nil {
+		config.Dial = proxy.SystemDialer.DialContext
+	}
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	sum := sha256.Sum256([]byte(config.Password))
+	c := &Client{
+		config:         config,
+		tlsConfig:      tlsConfig,
+		passwordSha256: sum[:],
+	}
+	c.sessionClient = session.NewClient(ctx, c.createOutboundConnection, config.Padding,
+		config.IdleSessionCheckInterval, config.IdleSessionTimeout, config.MinIdleSession)
+	if config.HealthHook != nil {
+		c.sessionClient.SetHealthHook(config.HealthHook)
+	}
+	c.sessionClient.SetHeartbeat(config.HeartbeatInterval, config.HeartbeatTimeout)
+	return c, nil
+}
+
+// DialContext connects to address through the server. For "udp" networks the
+// returned connection carries datagrams to address with UDP-over-TCP.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	destination := M.ParseSocksaddr(address)
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return c.CreateProxy(ctx, destination)
+	case strings.HasPrefix(network, "udp"):
+		conn, err := c.CreateProxy(ctx, uot.RequestDestination(uot.Version))
+		if err != nil {
+			return nil, err
+		}
+		return uot.NewLazyConn(conn, uot.Request{IsConnect: true, Destination: destination}), nil
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+}
+
+// CreateProxy opens a stream to destination
+func (c *Client) CreateProxy(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := c.sessionClient.CreateStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = M.SocksaddrSerializer.WriteAddrPort(conn, destination)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Probe dials the server and completes a TLS handshake without opening a session
+func (c *Client) Probe(ctx context.Context) error {
+	conn, err := c.dialTLS(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.HandshakeContext(ctx)
+}
+
+// PaddingFactory returns the padding scheme currently used with the server
+func (c *Client) PaddingFactory() *padding.PaddingFactory {
+	return c.sessionClient.PaddingFactory()
+}
+
+// SessionCount returns the number of open sessions
+func (c *Client) SessionCount() int {
+	return c.sessionClient.SessionCount()
+}
+
+// IdleSessionCount returns the number of pooled sessions without a stream
+func (c *Client) IdleSessionCount() int {
+	return c.sessionClient.IdleSessionCount()
+}
+
+// StreamCount returns the number of open streams
+func (c *Client) StreamCount() int {
+	return c.sessionClient.StreamCount()
+}
+
+// Close closes all sessions
+func (c *Client) Close() error {
+	return c.sessionClient.Close()
+}
+
+func (c *Client) dialTLS(ctx context.Context) (*tls.Conn, error) {
+	conn, err := c.config.Dial(ctx, "tcp", c.config.Server)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(conn, c.tlsConfig), nil
+}
+
+func (c *Client) createOutboundConnection(ctx context.Context) (net.Conn, error) {
+	conn, err := c.dialTLS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b := buf.NewPacket()
+	defer b.Release()
+
+	b.Write(c.passwordSha256)
+	var paddingLen int
+	if pad := c.sessionClient.PaddingFactory().GenerateRecordPayloadSizes(0); len(pad) > 0 {
+		paddingLen = pad[0]
+	}
+	binary.BigEndian.PutUint16(b.Extend(2), uint16(paddingLen))
+	if paddingLen > 0 {
+		b.WriteZeroN(paddingLen)
+	}
+
+	_, err = b.WriteTo(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Dial connects to address through the server with a Client that is only
+// used for this connection and closed with it.
+func Dial(ctx context.Context, network, address string, config ClientConfig) (net.Conn, error) {
+	config.MinIdleSession = 0
+	client, err := NewClient(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, network, address)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &clientConn{Conn: conn, client: client}, nil
+}
+
+type clientConn struct {
+	net.Conn
+	client *Client
+}
+
+func (c *clientConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close()
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"anytls/util"
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies for picking a server
+const (
+	strategyRoundRobin         = "round-robin"
+	strategyLeastActiveStreams = "least-active-streams"
+	strategyLowestLatency      = "lowest-latency"
+	strategyPrimaryBackup      = "primary-backup"
+)
+
+var strategies = []string{strategyRoundRobin, strategyLeastActiveStreams, strategyLowestLatency, strategyPrimaryBackup}
+
+// strategyAliases are the other accepted names of the strategies
+var strategyAliases = map[string]string{
+	"least-streams": strategyLeastActiveStreams,
+	"failover":      strategyPrimaryBackup,
+}
+
+// probeTimeout bounds a single health probe
+const probeTimeout = 10 * time.Second
+
+type balancer struct {
+	strategy  string
+	upstreams []*upstream
+	next      atomic.Uint32
+}
+
+func newBalancer(strategy string, upstreams []*upstream) *balancer {
+	return &balancer{
+		strategy:  strategy,
+		upstreams: upstreams,
+	}
+}
+
+// candidates returns the servers to try for a new stream, best first.
+// Healthy servers are ordered by the strategy and come before unhealthy ones,
+// so that a request still has a chance when every server is marked unhealthy.
+func (b *balancer) candidates() []*upstream {
+	ordered := slices.Clone(b.upstreams)
+	switch b.strategy {
+	case strategyRoundRobin:
+		// the modulo is taken before converting, int is 32 bits on some platforms
+		n := int((b.next.Add(1) - 1) % uint32(len(ordered)))
+		ordered = append(ordered[n:], ordered[:n]...)
+	case strategyLeastActiveStreams:
+		counts := make(map[*upstream]int, len(ordered))
+		for _, u := range ordered {
+			counts[u] = u.client.StreamCount()
+		}
+		slices.SortStableFunc(ordered, func(a, b *upstream) int {
+			return counts[a] - counts[b]
+		})
+	case strategyLowestLatency:
+		latency := func(u *upstream) int64 {
+			if l := u.latency.Load(); l > 0 {
+				return l
+			}
+			return math.MaxInt64
+		}
+		slices.SortStableFunc(ordered, func(a, b *upstream) int {
+			la, lb := latency(a), latency(b)
+			switch {
+			case la < lb:
+				return -1
+			case la > lb:
+				return 1
+			}
+			return 0
+		})
+	case strategyPrimaryBackup:
+		// configured order: the first server is the primary, the others are backups
+	}
+	slices.SortStableFunc(ordered, func(a, b *upstream) int {
+		switch {
+		case a.healthy() == b.healthy():
+			return 0
+		case a.healthy():
+			return -1
+		}
+		return 1
+	})
+	return ordered
+}
+
+// startProbing probes every server each interval, which keeps latencies
+// up to date and brings unhealthy servers back.
+func (b *balancer) startProbing(ctx context.Context, interval time.Duration) {
+	probeAll := func() {
+		var wg sync.WaitGroup
+		for _, u := range b.upstreams {
+			// healthy servers only need probing when latencies are compared
+			if b.strategy != strategyLowestLatency && u.healthy() {
+				continue
+			}
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				u.probe(ctx, probeTimeout)
+			}(u)
+		}
+		wg.Wait()
+	}
+	if b.strategy == strategyLowestLatency {
+		go probeAll()
+	}
+	util.StartRoutine(ctx, interval, probeAll)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"anytls/uri"
+	"anytls/util"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// clientConfig is the layout of the file given with -c (YAML or JSON).
+// Flags set explicitly on the command line take precedence over the file.
+type clientConfig struct {
+	// Inbounds are the local socks5/http listeners, -l
+	Inbounds []clientInbound `yaml:"inbounds" json:"inbounds"`
+	// Forwards are static forwards through the tunnel, -L
+	Forwards []clientForward `yaml:"forwards" json:"forwards"`
+	// Servers are the upstream AnyTLS servers, -s / -p / -sni
+	Servers  []clientServer `yaml:"servers" json:"servers"`
+	Balancer clientBalancer `yaml:"balancer" json:"balancer"`
+	Pool     clientPool     `yaml:"pool" json:"pool"`
+	// Heartbeat is the active keepalive of every session
+	Heartbeat heartbeatConfig `yaml:"heartbeat" json:"heartbeat"`
+	// Rules is the routing rules file, reloaded when it changes, -rules
+	Rules string `yaml:"rules" json:"rules"`
+	// Metrics is the Prometheus metrics listen address, -metrics
+	Metrics string `yaml:"metrics" json:"metrics"`
+	// DrainTimeout is how long to wait for open streams on SIGTERM / SIGINT, -drain-timeout;
+	// nil keeps the default, 0 does not wait
+	DrainTimeout *util.Duration `yaml:"drain_timeout" json:"drain_timeout"`
+}
+
+type clientInbound struct {
+	Listen string `yaml:"listen" json:"listen"`
+}
+
+type clientForward struct {
+	// Listen is the local address, Target the host:port reached through the tunnel
+	Listen string `yaml:"listen" json:"listen"`
+	Target string `yaml:"target" json:"target"`
+	// Network is tcp or udp, tcp by default
+	Network string `yaml:"network" json:"network"`
+}
+
+type clientServer struct {
+	// Address is host:port or an anytls:// link
+	Address  string `yaml:"address" json:"address"`
+	Password string `yaml:"password" json:"password"`
+	SNI      string `yaml:"sni" json:"sni"`
+	// Insecure skips the verification of the server certificate. Unset keeps
+	// the sample client default of not verifying, except for links: a link
+	// without insecure=1 verifies unless insecure is set here.
+	Insecure *bool `yaml:"insecure" json:"insecure"`
+	// PinSHA256 are SHA-256 hashes of the server leaf certificate or its public key, -pin-sha256
+	PinSHA256 []string `yaml:"pin_sha256" json:"pin_sha256"`
+	// CA is a PEM bundle to verify the server certificate against, -ca
+	CA string `yaml:"ca" json:"ca"`
+
+	// padding is the initial padding scheme of an anytls:// link
+	padding *padding.PaddingFactory
+}
+
+type heartbeatConfig struct {
+	// Interval is how long a session may stay silent before cmdHeartRequest is sent,
+	// -heartbeat-interval; nil keeps the default, 0 disables the heartbeat
+	Interval *util.Duration `yaml:"interval" json:"interval"`
+	// Timeout is how long to wait for cmdHeartResponse, -heartbeat-timeout
+	Timeout *util.Duration `yaml:"timeout" json:"timeout"`
+}
+
+type clientBalancer struct {
+	// Strategy picks the server for a new stream, -strategy
+	Strategy string `yaml:"strategy" json:"strategy"`
+	// MaxFailures consecutive session or cmdSYNACK failures mark a server unhealthy
+	MaxFailures int `yaml:"max_failures" json:"max_failures"`
+	// ProbeInterval is how often unhealthy servers (and, for lowest-latency, all servers) are probed
+	ProbeInterval util.Duration `yaml:"probe_interval" json:"probe_interval"`
+}
+
+type clientPool struct {
+	IdleSessionCheckInterval util.Duration `yaml:"idle_session_check_interval" json:"idle_session_check_interval"`
+	IdleSessionTimeout       util.Duration `yaml:"idle_session_timeout" json:"idle_session_timeout"`
+	// MinIdleSession is -m; nil keeps the default
+	MinIdleSession *int `yaml:"min_idle_session" json:"min_idle_session"`
+}
+
+// parseServerLink expands an anytls:// link in Address into its parts.
+// Parameters missing from the link keep the values of the config file; the
+// command line flags are applied afterwards and take precedence over both.
+func (s *clientServer) parseServerLink() error {
+	if !uri.IsURI(s.Address) {
+		return nil
+	}
+	link, err := uri.Parse(s.Address)
+	if err != nil {
+		return err
+	}
+	s.Address = link.Address()
+	if link.Password != "" {
+		s.Password = link.Password
+	}
+	if link.SNI != "" {
+		s.SNI = link.SNI
+	}
+	if link.Insecure || s.Insecure == nil {
+		s.Insecure = &link.Insecure
+	}
+	if len(link.PinSHA256) > 0 {
+		s.PinSHA256 = nil
+		for _, hash := range link.PinSHA256 {
+			s.PinSHA256 = append(s.PinSHA256, hex.EncodeToString(hash))
+		}
+	}
+	if link.Padding != nil {
+		if s.padding = padding.NewPaddingFactory(link.Padding); s.padding == nil {
+			return errors.New("padding: invalid padding scheme")
+		}
+	}
+	return nil
+}
+
+// validate checks the config and names the offending key in the error.
+func (c *clientConfig) validate() error {
+	if len(c.Inbounds) == 0 {
+		return errors.New("inbounds: at least one listener is required")
+	}
+	for i, inbound := range c.Inbounds {
+		if _, _, err := net.SplitHostPort(inbound.Listen); err != nil {
+			return fmt.Errorf("inbounds[%d].listen: %w", i, err)
+		}
+	}
+
+	for i, forward := range c.Forwards {
+		if forward.Network != "" && forward.Network != "tcp" && forward.Network != "udp" {
+			return fmt.Errorf("forwards[%d].network: expected tcp or udp, got %q", i, forward.Network)
+		}
+		if _, _, err := net.SplitHostPort(forward.Listen); err != nil {
+			return fmt.Errorf("forwards[%d].listen: %w", i, err)
+		}
+		if target := M.ParseSocksaddr(forward.Target); !target.IsValid() || target.Port == 0 {
+			return fmt.Errorf("forwards[%d].target: expected host:port, got %q", i, forward.Target)
+		}
+	}
+
+	if len(c.Servers) == 0 {
+		return errors.New("servers: please set -s server address")
+	}
+	for i, server := range c.Servers {
+		if server.Address == "" {
+			return fmt.Errorf("servers[%d].address: please set -s server address", i)
+		}
+		if _, _, err := net.SplitHostPort(server.Address); err != nil {
+			return fmt.Errorf("servers[%d].address: %w", i, err)
+		}
+		if server.Password == "" {
+			return fmt.Errorf("servers[%d].password: please set -p password", i)
+		}
+		for j, pin := range server.PinSHA256 {
+			if _, err := uri.ParsePin(pin); err != nil {
+				return fmt.Errorf("servers[%d].pin_sha256[%d]: %w", i, j, err)
+			}
+		}
+	}
+
+	if alias, ok := strategyAliases[c.Balancer.Strategy]; ok {
+		c.Balancer.Strategy = alias
+	}
+	if c.Balancer.Strategy != "" && !slices.Contains(strategies, c.Balancer.Strategy) {
+		return fmt.Errorf("balancer.strategy: unknown strategy %q, expected one of %s", c.Balancer.Strategy, strings.Join(strategies, ", "))
+	}
+	if c.Balancer.MaxFailures < 0 {
+		return errors.New("balancer.max_failures: must not be negative")
+	}
+	if c.Balancer.ProbeInterval < 0 {
+		return errors.New("balancer.probe_interval: must not be negative")
+	}
+
+	if c.Pool.IdleSessionCheckInterval < 0 {
+		return errors.New("pool.idle_session_check_interval: must not be negative")
+	}
+	if c.Pool.IdleSessionTimeout < 0 {
+		return errors.New("pool.idle_session_timeout: must not be negative")
+	}
+	if c.Pool.MinIdleSession != nil && *c.Pool.MinIdleSession < 0 {
+		return errors.New("pool.min_idle_session: must not be negative")
+	}
+	if d := c.Heartbeat.Interval; d != nil && *d < 0 {
+		return errors.New("heartbeat.interval: must not be negative")
+	}
+	if d := c.Heartbeat.Timeout; d != nil && *d <= 0 {
+		return errors.New("heartbeat.timeout: must be positive")
+	}
+	if d := c.DrainTimeout; d != nil && *d < 0 {
+		return errors.New("drain_timeout: must not be negative")
+	}
+	return nil
+}
+
+// applyDefaults fills in the values that were not configured.
+func (c *clientConfig) applyDefaults(minIdleSession int, drainTimeout, heartbeatInterval, heartbeatTimeout time.Duration) {
+	if c.Heartbeat.Interval == nil {
+		c.Heartbeat.Interval = (*util.Duration)(&heartbeatInterval)
+	}
+	if c.Heartbeat.Timeout == nil {
+		c.Heartbeat.Timeout = (*util.Duration)(&heartbeatTimeout)
+	}
+	if c.DrainTimeout == nil {
+		c.DrainTimeout = (*util.Duration)(&drainTimeout)
+	}
+	if c.Balancer.Strategy == "" {
+		c.Balancer.Strategy = strategyRoundRobin
+	}
+	if c.Balancer.MaxFailures == 0 {
+		c.Balancer.MaxFailures = 3
+	}
+	if c.Balancer.ProbeInterval == 0 {
+		c.Balancer.ProbeInterval = util.Duration(30 * time.Second)
+	}
+	if c.Pool.IdleSessionCheckInterval == 0 {
+		c.Pool.IdleSessionCheckInterval = util.Duration(30 * time.Second)
+	}
+	if c.Pool.IdleSessionTimeout == 0 {
+		c.Pool.IdleSessionTimeout = util.Duration(30 * time.Second)
+	}
+	if c.Pool.MinIdleSession == nil {
+		c.Pool.MinIdleSession = &minIdleSession
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/uot"
+	"github.com/sirupsen/logrus"
+)
+
+// udpForwardTimeout closes the tunnel of a UDP forward source idle for this long
+const udpForwardTimeout = 2 * time.Minute
+
+// parseForward parses -L [tcp://|udp://]listen=host:port; a listen address
+// without a host listens on 127.0.0.1
+func parseForward(s string) (clientForward, error) {
+	f := clientForward{Network: "tcp"}
+	if network, rest, found := strings.Cut(s, "://"); found {
+		f.Network, s = network, rest
+	}
+	listen, target, found := strings.Cut(s, "=")
+	if !found {
+		return f, fmt.Errorf("%q: expected listen=host:port", s)
+	}
+	if !strings.Contains(listen, ":") {
+		listen = net.JoinHostPort("127.0.0.1", listen)
+	}
+	f.Listen, f.Target = listen, target
+	return f, nil
+}
+
+// forwarder relays everything received on a local address through the tunnel
+// to a fixed target, without any proxy negotiation
+type forwarder struct {
+	network string
+	target  M.Socksaddr
+	// listener is set for tcp and packetConn for udp
+	listener   net.Listener
+	packetConn net.PacketConn
+}
+
+func listenForward(f clientForward) (*forwarder, error) {
+	fw := &forwarder{network: f.Network, target: M.ParseSocksaddr(f.Target)}
+	var err error
+	if f.Network == "udp" {
+		fw.packetConn, err = net.ListenPacket("udp", f.Listen)
+	} else {
+		fw.listener, err = net.Listen("tcp", f.Listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (f *forwarder) serve(ctx context.Context, client *myClient) {
+	if f.packetConn != nil {
+		f.serveUDP(ctx, client)
+	} else {
+		f.serveTCP(ctx, client)
+	}
+}
+
+// Close stops accepting, connections already forwarded stay open
+func (f *forwarder) Close() error {
+	if f.packetConn != nil {
+		return f.packetConn.Close()
+	}
+	return f.listener.Close()
+}
+
+func (f *forwarder) serveTCP(ctx context.Context, client *myClient) {
+	for {
+		c, err := f.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Fatalln("accept:", err)
+		}
+		go func() {
+			defer c.Close()
+			proxyC, err := client.CreateProxy(ctx, f.target)
+			if err != nil {
+				logrus.Errorln("CreateProxy:", err)
+				return
+			}
+			defer proxyC.Close()
+			bufio.CopyConn(ctx, c, proxyC)
+		}()
+	}
+}
+
+// serveUDP opens one UDP-over-TCP stream per source address
+func (f *forwarder) serveUDP(ctx context.Context, client *myClient) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	sources := make(map[string]*udpForwardSource)
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := f.packetConn.ReadFrom(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.Errorln("forward udp:", err)
+			}
+			return
+		}
+		key := addr.String()
+		mu.Lock()
+		source, exists := sources[key]
+		if !exists {
+			source = &udpForwardSource{addr: addr, packets: make(chan []byte, 64)}
+			sources[key] = source
+			go func() {
+				source.serve(ctx, client, f.packetConn, f.target)
+				mu.Lock()
+				delete(sources, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		select {
+		case source.packets <- bytes.Clone(buffer[:n]):
+		default:
+			// the stream is not keeping up, drop the packet as a UDP socket would
+		}
+	}
+}
+
+// udpForwardSource is the stream of one source address of a UDP forward
+type udpForwardSource struct {
+	addr    net.Addr
+	packets chan []byte
+	// lastActive is the UnixNano of the last packet in either direction
+	lastActive atomic.Int64
+}
+
+func (s *udpForwardSource) serve(ctx context.Context, client *myClient, conn net.PacketConn, target M.Socksaddr) {
+	proxyC, err := client.CreateProxy(ctx, uot.RequestDestination(2))
+	if err != nil {
+		logrus.Errorln("CreateProxy:", err)
+		return
+	}
+	uotC := uot.NewLazyConn(proxyC, uot.Request{IsConnect: true, Destination: target})
+	defer uotC.Close()
+	s.lastActive.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 65535)
+		for {
+			n, err := uotC.Read(buffer)
+			if err != nil {
+				return
+			}
+			s.lastActive.Store(time.Now().UnixNano())
+			if _, err := conn.WriteTo(buffer[:n], s.addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	idleCheck := time.NewTicker(udpForwardTimeout / 4)
+	defer idleCheck.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-idleCheck.C:
+			if time.Since(time.Unix(0, s.lastActive.Load())) > udpForwardTimeout {
+				return
+			}
+		case packet := <-s.packets:
+			if _, err := uotC.Write(packet); err != nil {
+				logrus.Debugln("forward udp:", err)
+				return
+			}
+			s.lastActive.Store(time.Now().UnixNano())
+		}
+	}
+}
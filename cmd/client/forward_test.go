@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    clientForward
+		wantErr bool
+	}{
+		{"8080=example.com:80", clientForward{Network: "tcp", Listen: "127.0.0.1:8080", Target: "example.com:80"}, false},
+		{"tcp://0.0.0.0:8080=10.0.0.1:80", clientForward{Network: "tcp", Listen: "0.0.0.0:8080", Target: "10.0.0.1:80"}, false},
+		{":8080=10.0.0.1:80", clientForward{Network: "tcp", Listen: ":8080", Target: "10.0.0.1:80"}, false},
+		{"udp://5353=1.1.1.1:53", clientForward{Network: "udp", Listen: "127.0.0.1:5353", Target: "1.1.1.1:53"}, false},
+		{"[::1]:2222=[2001:db8::1]:22", clientForward{Network: "tcp", Listen: "[::1]:2222", Target: "[2001:db8::1]:22"}, false},
+		{"8080", clientForward{}, true},
+		{"udp://8080", clientForward{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseForward(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseForward(%q) error %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseForward(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+// TestValidateForwards checks the parts parseForward leaves to validate
+func TestValidateForwards(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantErr bool
+	}{
+		{"8080=example.com:80", false},
+		{"udp://5353=1.1.1.1:53", false},
+		{"sctp://8080=example.com:80", true},
+		{"8080=example.com", true},
+		{"8080=example.com:0", true},
+		{"8080=", true},
+	}
+	for _, tt := range tests {
+		forward, err := parseForward(tt.s)
+		if err != nil {
+			t.Fatalf("parseForward(%q): %v", tt.s, err)
+		}
+		cfg := &clientConfig{
+			Inbounds: []clientInbound{{Listen: "127.0.0.1:1080"}},
+			Servers:  []clientServer{{Address: "127.0.0.1:8443", Password: "pw"}},
+			Forwards: []clientForward{forward},
+		}
+		if err := cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() of -L %q: %v, want error %v", tt.s, err, tt.wantErr)
+		}
+	}
+}
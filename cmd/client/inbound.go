@@ -4,7 +4,9 @@ import (
 	std_bufio "bufio"
 	"context"
 	"net"
+	"net/netip"
 	"runtime/debug"
+	"time"
 
 	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
@@ -46,11 +48,44 @@ func handleTcpConnection(ctx context.Context, c net.Conn, s *myClient) {
 
 // sing socks inbound
 
+// directDialer connects destinations that the routing rules send around the tunnel
+var directDialer = &network.DefaultDialer{Dialer: net.Dialer{Timeout: 5 * time.Second}}
+
+// route returns the action of the routing rules for destination, proxy when no rules are loaded
+func (c *myClient) route(ctx context.Context, network string, destination M.Socksaddr) (routeAction, []netip.Addr) {
+	if c.router == nil {
+		return actionProxy, nil
+	}
+	action, addresses := c.router.route(ctx, network, destination)
+	if action != actionProxy {
+		logrus.Debugln("[Route]", action, network, destination)
+	}
+	return action, addresses
+}
+
 func (c *myClient) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	proxyC, err := c.CreateProxy(ctx, metadata.Destination)
-	if err != nil {
-		logrus.Errorln("CreateProxy:", err)
-		return err
+	var proxyC net.Conn
+	var err error
+	action, addresses := c.route(ctx, network.NetworkTCP, metadata.Destination)
+	switch action {
+	case actionReject:
+		return errRejected
+	case actionDirect:
+		if len(addresses) > 0 {
+			proxyC, err = network.DialSerial(ctx, directDialer, network.NetworkTCP, metadata.Destination, addresses)
+		} else {
+			proxyC, err = directDialer.DialContext(ctx, network.NetworkTCP, metadata.Destination)
+		}
+		if err != nil {
+			logrus.Debugln("direct:", err)
+			return err
+		}
+	default:
+		proxyC, err = c.CreateProxy(ctx, metadata.Destination)
+		if err != nil {
+			logrus.Errorln("CreateProxy:", err)
+			return err
+		}
 	}
 	defer proxyC.Close()
 
@@ -58,6 +93,19 @@ func (c *myClient) NewConnection(ctx context.Context, conn net.Conn, metadata M.
 }
 
 func (c *myClient) NewPacketConnection(ctx context.Context, conn network.PacketConn, metadata M.Metadata) error {
+	switch action, _ := c.route(ctx, network.NetworkUDP, metadata.Destination); action {
+	case actionReject:
+		return errRejected
+	case actionDirect:
+		udpC, err := directDialer.ListenPacket(ctx, metadata.Destination)
+		if err != nil {
+			logrus.Debugln("direct:", err)
+			return err
+		}
+		defer udpC.Close()
+		return bufio.CopyPacketConn(ctx, conn, bufio.NewPacketConn(udpC))
+	}
+
 	proxyC, err := c.CreateProxy(ctx, uot.RequestDestination(2))
 	if err != nil {
 		logrus.Errorln("CreateProxy:", err)
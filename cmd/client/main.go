@@ -1,52 +1,128 @@
 package main
 
 import (
-	"anytls/proxy"
+	"anytls"
+	"anytls/metrics"
+	"anytls/proxy/padding"
 	"anytls/util"
 	"context"
-	"crypto/sha256"
-	"crypto/tls"
+	"errors"
 	"flag"
+	"io"
 	"net"
-	"net/url"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/sagernet/sing/common/atomic"
 	"github.com/sirupsen/logrus"
 )
 
-var passwordSha256 []byte
+// stringList is a flag that may be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
 func main() {
+	var serverAddrs, forwards stringList
+	configPath := flag.String("c", "", "Config file (.yaml, .yml or .json); flags set on the command line take precedence")
 	listen := flag.String("l", "127.0.0.1:1080", "socks5 listen port")
-	serverAddr := flag.String("s", "", "Server address or anytls:// link")
+	flag.Var(&serverAddrs, "s", "Server address or anytls:// link, repeat for several servers")
+	flag.Var(&forwards, "L", "Forward [tcp://|udp://]listen=host:port through the tunnel, repeat for several forwards")
 	sni := flag.String("sni", "", "Server Name Indication")
 	password := flag.String("p", "", "Password")
+	pinSHA256 := flag.String("pin-sha256", "", "Comma-separated SHA-256 of the server certificate or its public key (hex or base64)")
+	caFile := flag.String("ca", "", "Verify the server certificate against this CA bundle (PEM) instead of the system roots")
+	strategy := flag.String("strategy", strategyRoundRobin, "Server selection strategy: "+strings.Join(strategies, ", "))
 	minIdleSession := flag.Int("m", 5, "Reserved min idle session")
+	rulesPath := flag.String("rules", "", "Routing rules file (.yaml, .yml or .json) deciding between proxy, direct and reject")
+	metricsAddr := flag.String("metrics", "", "Prometheus metrics listen address, e.g. 127.0.0.1:9101")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "How long to wait for open connections on SIGTERM / SIGINT")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 30*time.Second, "Send a heartbeat on sessions silent for this long")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 5*time.Second, "Close a session whose heartbeat is not answered within this time")
 	flag.Parse()
 
-	if serverURL, err := url.Parse(*serverAddr); err == nil {
-		if serverURL.Scheme == "anytls" {
-			*serverAddr = serverURL.Host
-			if serverURL.User != nil {
-				*password = serverURL.User.String()
-			}
-			query := serverURL.Query()
-			*sni = query.Get("sni")
+	cfg := &clientConfig{}
+	if *configPath != "" {
+		if err := util.LoadConfigFile(*configPath, cfg); err != nil {
+			logrus.Fatalln("load config:", err)
 		}
 	}
-
-	if *serverAddr == "" {
-		logrus.Fatalln("please set -s server adreess")
+	var passwordSet, sniSet, pinSet, caSet bool
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "l":
+			cfg.Inbounds = []clientInbound{{Listen: *listen}}
+		case "L":
+			cfg.Forwards = nil
+			for _, s := range forwards {
+				forward, err := parseForward(s)
+				if err != nil {
+					logrus.Fatalln("-L:", err)
+				}
+				cfg.Forwards = append(cfg.Forwards, forward)
+			}
+		case "s":
+			cfg.Servers = nil
+			for _, addr := range serverAddrs {
+				cfg.Servers = append(cfg.Servers, clientServer{Address: addr})
+			}
+		case "sni":
+			sniSet = true
+		case "p":
+			passwordSet = true
+		case "pin-sha256":
+			pinSet = true
+		case "ca":
+			caSet = true
+		case "strategy":
+			cfg.Balancer.Strategy = *strategy
+		case "m":
+			cfg.Pool.MinIdleSession = minIdleSession
+		case "rules":
+			cfg.Rules = *rulesPath
+		case "metrics":
+			cfg.Metrics = *metricsAddr
+		case "drain-timeout":
+			cfg.DrainTimeout = (*util.Duration)(drainTimeout)
+		case "heartbeat-interval":
+			cfg.Heartbeat.Interval = (*util.Duration)(heartbeatInterval)
+		case "heartbeat-timeout":
+			cfg.Heartbeat.Timeout = (*util.Duration)(heartbeatTimeout)
+		}
+	})
+	// -p / -sni / -pin-sha256 / -ca apply to every server and take precedence over anytls:// links
+	for i := range cfg.Servers {
+		if err := cfg.Servers[i].parseServerLink(); err != nil {
+			logrus.Fatalf("config: servers[%d].address: %v", i, err)
+		}
+		if passwordSet {
+			cfg.Servers[i].Password = *password
+		}
+		if sniSet {
+			cfg.Servers[i].SNI = *sni
+		}
+		if pinSet {
+			cfg.Servers[i].PinSHA256 = strings.Split(*pinSHA256, ",")
+		}
+		if caSet {
+			cfg.Servers[i].CA = *caFile
+		}
 	}
-
-	if *password == "" {
-		logrus.Fatalln("please set -p password")
+	if len(cfg.Inbounds) == 0 {
+		cfg.Inbounds = []clientInbound{{Listen: *listen}}
 	}
-
-	if _, _, err := net.SplitHostPort(*serverAddr); err != nil {
-		logrus.Fatalln("error server address:", *serverAddr, err)
+	if err := cfg.validate(); err != nil {
+		logrus.Fatalln("config:", err)
 	}
+	cfg.applyDefaults(*minIdleSession, *drainTimeout, *heartbeatInterval, *heartbeatTimeout)
 
 	logLevel, err := logrus.ParseLevel(os.Getenv("LOG_LEVEL"))
 	if err != nil {
@@ -54,48 +130,125 @@ func main() {
 	}
 	logrus.SetLevel(logLevel)
 
-	var sum = sha256.Sum256([]byte(*password))
-	passwordSha256 = sum[:]
-
 	logrus.Infoln("[Client]", util.ProgramVersionName)
-	logrus.Infoln("[Client] socks5/http", *listen, "=>", *serverAddr)
 
-	listener, err := net.Listen("tcp", *listen)
-	if err != nil {
-		logrus.Fatalln("listen socks5 tcp:", err)
+	serverNames := make([]string, 0, len(cfg.Servers))
+	for _, server := range cfg.Servers {
+		serverNames = append(serverNames, server.Address)
 	}
-
-	// You can only use `InsecureSkipVerify` by default in the sample client; it is not recommended for use in production code.
-	tlsConfig := &tls.Config{
-		ServerName:         *sni,
-		InsecureSkipVerify: true,
+	listeners := make([]net.Listener, 0, len(cfg.Inbounds))
+	for _, inbound := range cfg.Inbounds {
+		logrus.Infoln("[Client] socks5/http", inbound.Listen, "=>", strings.Join(serverNames, ", "))
+		listener, err := net.Listen("tcp", inbound.Listen)
+		if err != nil {
+			logrus.Fatalln("listen socks5 tcp:", err)
+		}
+		listeners = append(listeners, listener)
 	}
-	if tlsConfig.ServerName == "" {
-		// disable the SNI
-		tlsConfig.ServerName = "127.0.0.1"
+	forwarders := make([]*forwarder, 0, len(cfg.Forwards))
+	for _, forward := range cfg.Forwards {
+		if forward.Network == "" {
+			forward.Network = "tcp"
+		}
+		logrus.Infoln("[Client] forward", forward.Network, forward.Listen, "=>", forward.Target)
+		f, err := listenForward(forward)
+		if err != nil {
+			logrus.Fatalln("listen forward:", err)
+		}
+		forwarders = append(forwarders, f)
 	}
 
+	var keyLogWriter io.Writer
 	path := strings.TrimSpace(os.Getenv("TLS_KEY_LOG"))
 	if path != "" {
 		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 		if err == nil {
-			tlsConfig.KeyLogWriter = f
+			keyLogWriter = f
 		}
 	}
 
+	upstreams := make([]*upstream, 0, len(cfg.Servers))
+	for i, server := range cfg.Servers {
+		u, err := newUpstream(server, keyLogWriter, cfg.Balancer.MaxFailures)
+		if err != nil {
+			logrus.Fatalf("config: servers[%d]: %v", i, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+
 	ctx := context.Background()
-	client := NewMyClient(ctx, func(ctx context.Context) (net.Conn, error) {
-		conn, err := proxy.SystemDialer.DialContext(ctx, "tcp", *serverAddr)
+	client, err := NewMyClient(ctx, upstreams, cfg.Balancer.Strategy, cfg.Pool, cfg.Heartbeat)
+	if err != nil {
+		logrus.Fatalln("client:", err)
+	}
+	if len(upstreams) > 1 {
+		logrus.Infoln("[Client] strategy:", cfg.Balancer.Strategy)
+		client.balancer.startProbing(ctx, time.Duration(cfg.Balancer.ProbeInterval))
+	}
+
+	if cfg.Rules != "" {
+		client.router, err = newRouter(cfg.Rules)
 		if err != nil {
-			return nil, err
+			logrus.Fatalln("rules:", err)
 		}
-		conn = tls.Client(conn, tlsConfig)
-		return conn, nil
-	}, *minIdleSession)
+		logrus.Infoln("[Client] routing rules:", cfg.Rules)
+		util.StartRoutine(ctx, rulesCheckInterval, client.router.checkModified)
+	}
+
+	if cfg.Metrics != "" {
+		registerClientGauges(client)
+		go func() {
+			logrus.Infoln("[Client] metrics http://" + cfg.Metrics + "/metrics")
+			if err := metrics.ListenAndServe(cfg.Metrics); err != nil {
+				logrus.Errorln("metrics:", err)
+			}
+		}()
+	}
 
+	closers := make([]io.Closer, 0, len(listeners)+len(forwarders))
+	for _, listener := range listeners {
+		go acceptLoop(ctx, listener, client)
+		closers = append(closers, listener)
+	}
+	for _, f := range forwarders {
+		go f.serve(ctx, client)
+		closers = append(closers, f)
+	}
+	waitForShutdown(closers, client, time.Duration(*cfg.DrainTimeout))
+}
+
+// newUpstream prepares the TLS dialer for one server
+func newUpstream(server clientServer, keyLogWriter io.Writer, maxFailures int) (*upstream, error) {
+	tlsConfig, err := newTLSConfig(server, keyLogWriter)
+	if err != nil {
+		return nil, err
+	}
+	var initialPadding *atomic.TypedValue[*padding.PaddingFactory]
+	if server.padding != nil {
+		initialPadding = &atomic.TypedValue[*padding.PaddingFactory]{}
+		initialPadding.Store(server.padding)
+	}
+
+	return &upstream{
+		address:       server.Address,
+		maxFailures:   int32(maxFailures),
+		verifiesRoots: !tlsConfig.InsecureSkipVerify && server.CA == "",
+		config: anytls.ClientConfig{
+			Server:    server.Address,
+			Password:  server.Password,
+			TLSConfig: tlsConfig,
+			Padding:   initialPadding,
+		},
+	}, nil
+}
+
+func acceptLoop(ctx context.Context, listener net.Listener, client *myClient) {
 	for {
 		c, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logrus.Fatalln("accept:", err)
 		}
 		go handleTcpConnection(ctx, c, client)
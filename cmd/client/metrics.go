@@ -0,0 +1,33 @@
+package main
+
+import (
+	"anytls/metrics"
+)
+
+// registerClientGauges registers live gauges read from the session pools of all servers
+func registerClientGauges(c *myClient) {
+	sum := func(f func(u *upstream) int) func() float64 {
+		return func() float64 {
+			var total int
+			for _, u := range c.upstreams {
+				total += f(u)
+			}
+			return float64(total)
+		}
+	}
+	metrics.NewGaugeFunc("anytls_client_sessions", "Live sessions.", sum(func(u *upstream) int {
+		return u.client.SessionCount()
+	}))
+	metrics.NewGaugeFunc("anytls_client_idle_sessions", "Sessions in the idle pool.", sum(func(u *upstream) int {
+		return u.client.IdleSessionCount()
+	}))
+	metrics.NewGaugeFunc("anytls_client_streams", "Live streams over all sessions.", sum(func(u *upstream) int {
+		return u.client.StreamCount()
+	}))
+	metrics.NewGaugeFunc("anytls_client_unhealthy_servers", "Servers currently marked unhealthy.", sum(func(u *upstream) int {
+		if u.healthy() {
+			return 0
+		}
+		return 1
+	}))
+}
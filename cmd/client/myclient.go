@@ -1,68 +1,150 @@
 package main
 
 import (
-	"anytls/proxy/padding"
-	"anytls/proxy/session"
-	"anytls/util"
+	"anytls"
 	"context"
-	"encoding/binary"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/sagernet/sing/common/buf"
 	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
 )
 
 type myClient struct {
-	dialOut       util.DialOutFunc
-	sessionClient *session.Client
+	upstreams []*upstream
+	balancer  *balancer
+	// router holds the routing rules, nil sends everything through the tunnel
+	router *router
 }
 
-func NewMyClient(ctx context.Context, dialOut util.DialOutFunc, minIdleSession int) *myClient {
+// upstream is one AnyTLS server with its own session pool
+type upstream struct {
+	address string
+	// config is completed with the pool and heartbeat options by NewMyClient
+	config anytls.ClientConfig
+	client *anytls.Client
+
+	// maxFailures consecutive failures mark the server unhealthy until a probe succeeds
+	maxFailures int32
+	failures    atomic.Int32
+	unhealthy   atomic.Bool
+	// latency is the last probed TLS handshake time in nanoseconds, 0 if unknown
+	latency atomic.Int64
+
+	// verifiesRoots is set when the certificate is checked against the system
+	// roots only, a self-signed server then fails in a way worth explaining
+	verifiesRoots bool
+	hintOnce      sync.Once
+}
+
+func NewMyClient(ctx context.Context, upstreams []*upstream, strategy string, pool clientPool, heartbeat heartbeatConfig) (*myClient, error) {
 	s := &myClient{
-		dialOut: dialOut,
+		upstreams: upstreams,
+		balancer:  newBalancer(strategy, upstreams),
 	}
-	s.sessionClient = session.NewClient(ctx, s.createOutboundConnection, &padding.DefaultPaddingFactory, time.Second*30, time.Second*30, minIdleSession)
-	return s
+	for _, u := range upstreams {
+		u.config.IdleSessionCheckInterval = time.Duration(pool.IdleSessionCheckInterval)
+		u.config.IdleSessionTimeout = time.Duration(pool.IdleSessionTimeout)
+		u.config.MinIdleSession = *pool.MinIdleSession
+		u.config.HeartbeatInterval = time.Duration(*heartbeat.Interval)
+		u.config.HeartbeatTimeout = time.Duration(*heartbeat.Timeout)
+		u.config.HealthHook = u.reportResult
+		client, err := anytls.NewClient(ctx, u.config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", u.address, err)
+		}
+		u.client = client
+	}
+	return s, nil
 }
 
+// CreateProxy opens a stream on the server picked by the balancer, trying the
+// other servers in turn when no session can be created.
 func (c *myClient) CreateProxy(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
-	conn, err := c.sessionClient.CreateStream(ctx)
-	if err != nil {
-		return nil, err
-	}
-	err = M.SocksaddrSerializer.WriteAddrPort(conn, destination)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	var errs []error
+	for _, u := range c.balancer.candidates() {
+		conn, err := u.client.CreateProxy(ctx, destination)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u.address, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		return conn, nil
 	}
-	return conn, nil
+	return nil, errors.Join(errs...)
 }
 
-func (c *myClient) createOutboundConnection(ctx context.Context) (net.Conn, error) {
-	conn, err := c.dialOut(ctx)
-	if err != nil {
-		return nil, err
+// streamCount returns the number of open streams over all servers
+func (c *myClient) streamCount() int {
+	var count int
+	for _, u := range c.upstreams {
+		count += u.client.StreamCount()
 	}
+	return count
+}
 
-	b := buf.NewPacket()
-	defer b.Release()
+// Close closes the session pools of all servers
+func (c *myClient) Close() error {
+	for _, u := range c.upstreams {
+		u.client.Close()
+	}
+	return nil
+}
 
-	b.Write(passwordSha256)
-	var paddingLen int
-	if pad := padding.DefaultPaddingFactory.Load().GenerateRecordPayloadSizes(0); len(pad) > 0 {
-		paddingLen = pad[0]
+// reportResult is the health hook of the session pool
+func (u *upstream) reportResult(err error) {
+	u.hintVerifyError(err)
+	if err == nil {
+		u.failures.Store(0)
+		if u.unhealthy.Swap(false) {
+			logrus.Infoln("[Client] server", u.address, "is healthy again")
+		}
+		return
 	}
-	binary.BigEndian.PutUint16(b.Extend(2), uint16(paddingLen))
-	if paddingLen > 0 {
-		b.WriteZeroN(paddingLen)
+	if u.failures.Add(1) >= u.maxFailures && !u.unhealthy.Swap(true) {
+		logrus.Warnln("[Client] server", u.address, "marked unhealthy:", err)
 	}
+}
+
+func (u *upstream) healthy() bool {
+	return !u.unhealthy.Load()
+}
 
-	_, err = b.WriteTo(conn)
-	if err != nil {
-		conn.Close()
-		return nil, err
+// probe dials the server and completes a TLS handshake, recording the latency.
+// An unhealthy server becomes healthy again once a probe succeeds.
+func (u *upstream) probe(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := u.client.Probe(ctx); err != nil {
+		u.hintVerifyError(err)
+		logrus.Debugln("[Client] probe", u.address, "failed:", err)
+		return
+	}
+	u.latency.Store(int64(time.Since(start)))
+	u.failures.Store(0)
+	if u.unhealthy.Swap(false) {
+		logrus.Infoln("[Client] server", u.address, "is healthy again, latency", time.Since(start).Round(time.Millisecond))
 	}
+}
 
-	return conn, nil
+// hintVerifyError explains once how to connect to a self-signed server when
+// err is a certificate verification failure
+func (u *upstream) hintVerifyError(err error) {
+	var verifyErr *tls.CertificateVerificationError
+	if !u.verifiesRoots || !errors.As(err, &verifyErr) {
+		return
+	}
+	u.hintOnce.Do(func() {
+		logrus.Warnln("[Client] server", u.address, "certificate verification failed:", err)
+		logrus.Warnln("[Client] a self-signed server needs pin-sha256 or insecure=1 in the anytls:// link, or -pin-sha256 / insecure: true")
+	})
 }
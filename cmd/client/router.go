@@ -0,0 +1,319 @@
+package main
+
+import (
+	"anytls/geodata"
+	"anytls/route"
+	"anytls/util"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// rulesCheckInterval is how often the rules file and the geo files are checked for changes
+const rulesCheckInterval = 10 * time.Second
+
+// routeAction is what to do with a connection
+type routeAction string
+
+const (
+	actionProxy  routeAction = "proxy"
+	actionDirect routeAction = "direct"
+	actionReject routeAction = "reject"
+)
+
+var errRejected = errors.New("rejected by routing rules")
+
+// routeRulesConfig is the layout of the rules file given with -rules (YAML or JSON)
+type routeRulesConfig struct {
+	// GeoIP and GeoSite are v2ray geoip.dat / geosite.dat files, relative to the rules file
+	GeoIP   string `yaml:"geoip" json:"geoip"`
+	GeoSite string `yaml:"geosite" json:"geosite"`
+	// Rules are matched in order, the first match wins
+	Rules []routeRuleConfig `yaml:"rules" json:"rules"`
+	// Final is the action when no rule matches, proxy by default
+	Final routeAction `yaml:"final" json:"final"`
+}
+
+type routeRuleConfig struct {
+	DomainSuffix  []string `yaml:"domain_suffix" json:"domain_suffix"`
+	DomainKeyword []string `yaml:"domain_keyword" json:"domain_keyword"`
+	DomainRegex   []string `yaml:"domain_regex" json:"domain_regex"`
+	IPCIDR        []string `yaml:"ip_cidr" json:"ip_cidr"`
+	// GeoIP and GeoSite are country codes / categories in the geo files
+	GeoIP   []string `yaml:"geoip" json:"geoip"`
+	GeoSite []string `yaml:"geosite" json:"geosite"`
+	// NoResolve skips the IP conditions for domain destinations instead of
+	// resolving them locally
+	NoResolve bool `yaml:"no_resolve" json:"no_resolve"`
+	// Port is a port or a range such as 8000-9000
+	Port []string `yaml:"port" json:"port"`
+	// Network is tcp or udp, empty matches both
+	Network string      `yaml:"network" json:"network"`
+	Action  routeAction `yaml:"action" json:"action"`
+}
+
+// routeTable is a loaded rule set, replaced as a whole on reload
+type routeTable struct {
+	rules []*routeRule
+	final routeAction
+}
+
+// routeRule matches when any of its domain, IP and geo conditions matches
+// and its port and network conditions hold
+type routeRule struct {
+	route.Matcher
+	network   string
+	noResolve bool
+	action    routeAction
+}
+
+// router decides per destination whether to use the tunnel, dial directly or reject
+type router struct {
+	path  string
+	table atomic.Pointer[routeTable]
+	// stamps are the rules file and the geo files of the current table
+	stamps map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newRouter(path string) (*router, error) {
+	r := &router{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkModified reloads the rules when the rules file or a geo file changed.
+// A rule set that fails to load leaves the current one in place.
+func (r *router) checkModified() {
+	changed := false
+	for path, stamp := range r.stamps {
+		if current, err := statFile(path); err != nil || current != stamp {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.reload(); err != nil {
+		logrus.Errorln("[Route] reload rules (keeping the current rules):", err)
+		return
+	}
+	logrus.Infoln("[Route] rules reloaded:", r.path)
+}
+
+func (r *router) reload() error {
+	stamps := make(map[string]fileStamp)
+	stamp, err := statFile(r.path)
+	if err != nil {
+		return err
+	}
+	stamps[r.path] = stamp
+
+	var c routeRulesConfig
+	if err := util.LoadConfigFile(r.path, &c); err != nil {
+		return err
+	}
+	dir := filepath.Dir(r.path)
+	resolvePath := func(name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(dir, name)
+	}
+	c.GeoIP, c.GeoSite = resolvePath(c.GeoIP), resolvePath(c.GeoSite)
+	for _, path := range []string{c.GeoIP, c.GeoSite} {
+		if path == "" {
+			continue
+		}
+		if stamps[path], err = statFile(path); err != nil {
+			return err
+		}
+	}
+
+	table, err := newRouteTable(c)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.path, err)
+	}
+	r.table.Store(table)
+	r.stamps = stamps
+	return nil
+}
+
+func newRouteTable(c routeRulesConfig) (*routeTable, error) {
+	table := &routeTable{final: actionProxy}
+	if c.Final != "" {
+		if !validAction(c.Final) {
+			return nil, fmt.Errorf("final: unknown action %q, expected proxy, direct or reject", c.Final)
+		}
+		table.final = c.Final
+	}
+
+	// geo entries are loaded once for all rules
+	var geoIPCodes, geoSiteCodes []string
+	for _, rc := range c.Rules {
+		geoIPCodes = append(geoIPCodes, rc.GeoIP...)
+		geoSiteCodes = append(geoSiteCodes, rc.GeoSite...)
+	}
+	var geoIP map[string][]netip.Prefix
+	var geoSite map[string][]geodata.Domain
+	var err error
+	if len(geoIPCodes) > 0 {
+		if c.GeoIP == "" {
+			return nil, errors.New("geoip: rules use geoip but no geoip file is set")
+		}
+		if geoIP, err = geodata.LoadGeoIP(c.GeoIP, geoIPCodes); err != nil {
+			return nil, err
+		}
+	}
+	if len(geoSiteCodes) > 0 {
+		if c.GeoSite == "" {
+			return nil, errors.New("geosite: rules use geosite but no geosite file is set")
+		}
+		if geoSite, err = geodata.LoadGeoSite(c.GeoSite, geoSiteCodes); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, rc := range c.Rules {
+		rule, err := newRouteRule(rc, geoIP, geoSite)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d].%w", i, err)
+		}
+		table.rules = append(table.rules, rule)
+	}
+	return table, nil
+}
+
+func validAction(action routeAction) bool {
+	return action == actionProxy || action == actionDirect || action == actionReject
+}
+
+func newRouteRule(c routeRuleConfig, geoIP map[string][]netip.Prefix, geoSite map[string][]geodata.Domain) (*routeRule, error) {
+	if !validAction(c.Action) {
+		return nil, fmt.Errorf("action: unknown action %q, expected proxy, direct or reject", c.Action)
+	}
+	if c.Network != "" && c.Network != "tcp" && c.Network != "udp" {
+		return nil, fmt.Errorf("network: expected tcp or udp, got %q", c.Network)
+	}
+	rule := &routeRule{
+		network:   c.Network,
+		noResolve: c.NoResolve,
+		action:    c.Action,
+	}
+	for _, suffix := range c.DomainSuffix {
+		rule.AddDomainSuffix(suffix)
+	}
+	for _, keyword := range c.DomainKeyword {
+		rule.AddDomainKeyword(keyword)
+	}
+	for i, expr := range c.DomainRegex {
+		if err := rule.AddDomainRegex(expr); err != nil {
+			return nil, fmt.Errorf("domain_regex[%d]: %w", i, err)
+		}
+	}
+	for _, code := range c.GeoSite {
+		for _, domain := range geoSite[strings.ToLower(code)] {
+			switch domain.Type {
+			case geodata.DomainFull:
+				rule.AddDomainFull(domain.Value)
+			case geodata.DomainSuffix:
+				rule.AddDomainSuffix(domain.Value)
+			case geodata.DomainKeyword:
+				rule.AddDomainKeyword(domain.Value)
+			case geodata.DomainRegex:
+				if err := rule.AddDomainRegex(domain.Value); err != nil {
+					return nil, fmt.Errorf("geosite %s: %w", code, err)
+				}
+			}
+		}
+	}
+	for i, cidr := range c.IPCIDR {
+		prefix, err := route.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("ip_cidr[%d]: %w", i, err)
+		}
+		rule.AddPrefix(prefix)
+	}
+	for _, code := range c.GeoIP {
+		rule.AddPrefix(geoIP[strings.ToLower(code)]...)
+	}
+	for i, port := range c.Port {
+		pr, err := route.ParsePortRange(port)
+		if err != nil {
+			return nil, fmt.Errorf("port[%d]: %w", i, err)
+		}
+		rule.AddPortRange(pr)
+	}
+	return rule, nil
+}
+
+// route returns the action for a connection to destination. A domain is only
+// resolved, with the system resolver, when a rule with IP conditions and
+// without no_resolve is reached; the addresses are returned so that a direct
+// dial uses the same ones.
+func (r *router) route(ctx context.Context, network string, destination M.Socksaddr) (routeAction, []netip.Addr) {
+	table := r.table.Load()
+	var domain string
+	if destination.IsFqdn() {
+		domain = route.NormalizeDomain(destination.Fqdn)
+	}
+	var resolved bool
+	var addresses []netip.Addr
+	if destination.IsIP() {
+		resolved, addresses = true, []netip.Addr{destination.Addr.Unmap()}
+	}
+
+	for _, rule := range table.rules {
+		if rule.network != "" && rule.network != network {
+			continue
+		}
+		if !rule.MatchPort(destination.Port) {
+			continue
+		}
+		if !rule.HasDestination() || (domain != "" && rule.MatchDomain(domain)) {
+			return rule.action, addresses
+		}
+		if !rule.HasIP() || (domain != "" && rule.noResolve) {
+			continue
+		}
+		if !resolved {
+			resolved = true
+			ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", domain)
+			if err != nil {
+				logrus.Warnln("[Route] resolve", domain, "failed, IP rules do not match it:", err)
+			}
+			for _, ip := range ips {
+				addresses = append(addresses, ip.Unmap())
+			}
+		}
+		if rule.MatchIP(addresses) {
+			return rule.action, addresses
+		}
+	}
+	return table.final, addresses
+}
+
+func statFile(name string) (fileStamp, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestRoute(t *testing.T) {
+	table, err := newRouteTable(routeRulesConfig{
+		Rules: []routeRuleConfig{
+			{Port: []string{"25"}, Action: actionReject},
+			{DomainSuffix: []string{".Local.example"}, Action: actionDirect},
+			{DomainKeyword: []string{"ads"}, Network: "tcp", Action: actionReject},
+			{DomainRegex: []string{`^cdn\d+\.`}, Port: []string{"8000-9000"}, Action: actionDirect},
+			{IPCIDR: []string{"127.0.0.0/8"}, Port: []string{"81"}, NoResolve: true, Action: actionReject},
+			// only port 80 reaches the IP rule, other domains are never resolved
+			{IPCIDR: []string{"127.0.0.0/8", "::1", "192.168.0.0/16"}, Port: []string{"80"}, Action: actionDirect},
+		},
+		Final: actionProxy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &router{}
+	r.table.Store(table)
+
+	tests := []struct {
+		name        string
+		network     string
+		destination string
+		want        routeAction
+		addresses   int
+	}{
+		{"port", N.NetworkTCP, "example.com:25", actionReject, 0},
+		{"domain suffix", N.NetworkTCP, "a.b.local.example:443", actionDirect, 0},
+		{"domain suffix itself", N.NetworkTCP, "LOCAL.example.:443", actionDirect, 0},
+		{"keyword", N.NetworkTCP, "myads.example:443", actionReject, 0},
+		{"keyword wrong network", N.NetworkUDP, "myads.example:443", actionProxy, 0},
+		{"regex in port range", N.NetworkTCP, "cdn1.example:8443", actionDirect, 0},
+		{"regex out of port range", N.NetworkTCP, "cdn1.example:443", actionProxy, 0},
+		{"ip", N.NetworkTCP, "192.168.1.1:80", actionDirect, 1},
+		{"single address", N.NetworkUDP, "[::1]:80", actionDirect, 1},
+		{"ip out of range", N.NetworkTCP, "1.1.1.1:80", actionProxy, 1},
+		{"resolved domain", N.NetworkTCP, "localhost:80", actionDirect, -1},
+		{"no_resolve ip", N.NetworkTCP, "127.0.0.1:81", actionReject, 1},
+		{"no_resolve domain", N.NetworkTCP, "localhost:81", actionProxy, 0},
+		{"final", N.NetworkTCP, "example.com:443", actionProxy, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, addresses := r.route(context.Background(), tt.network, M.ParseSocksaddr(tt.destination))
+			if action != tt.want {
+				t.Errorf("route(%s %s) = %s, want %s", tt.network, tt.destination, action, tt.want)
+			}
+			if tt.addresses >= 0 && len(addresses) != tt.addresses {
+				t.Errorf("route(%s %s) returned %d addresses, want %d", tt.network, tt.destination, len(addresses), tt.addresses)
+			}
+			if tt.addresses < 0 && len(addresses) == 0 {
+				t.Errorf("route(%s %s) returned no addresses for a resolved domain", tt.network, tt.destination)
+			}
+		})
+	}
+}
+
+func TestNewRouteTableErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		c    routeRulesConfig
+	}{
+		{"final", routeRulesConfig{Final: "drop"}},
+		{"action", routeRulesConfig{Rules: []routeRuleConfig{{Action: "drop"}}}},
+		{"network", routeRulesConfig{Rules: []routeRuleConfig{{Network: "sctp", Action: actionProxy}}}},
+		{"regex", routeRulesConfig{Rules: []routeRuleConfig{{DomainRegex: []string{"("}, Action: actionProxy}}}},
+		{"ip_cidr", routeRulesConfig{Rules: []routeRuleConfig{{IPCIDR: []string{"10.0.0.0/40"}, Action: actionProxy}}}},
+		{"port", routeRulesConfig{Rules: []routeRuleConfig{{Port: []string{"90-80"}, Action: actionProxy}}}},
+		{"geoip without file", routeRulesConfig{Rules: []routeRuleConfig{{GeoIP: []string{"cn"}, Action: actionDirect}}}},
+		{"geosite without file", routeRulesConfig{Rules: []routeRuleConfig{{GeoSite: []string{"cn"}, Action: actionDirect}}}},
+	}
+	for _, tt := range tests {
+		if _, err := newRouteTable(tt.c); err == nil {
+			t.Errorf("%s: invalid rules accepted", tt.name)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// waitForShutdown blocks until SIGTERM / SIGINT, then stops accepting, waits up to
+// drainTimeout for open streams to finish and closes all sessions.
+// A second signal exits immediately.
+func waitForShutdown(closers []io.Closer, client *myClient, drainTimeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logrus.Infoln("[Client] received", sig, "draining open streams for up to", drainTimeout)
+
+	go func() {
+		sig := <-signals
+		logrus.Warnln("[Client] received", sig, "again, exiting now")
+		os.Exit(1)
+	}()
+
+	for _, closer := range closers {
+		closer.Close()
+	}
+
+	deadline := time.Now().Add(drainTimeout)
+	for client.streamCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if count := client.streamCount(); count > 0 {
+		logrus.Warnln("[Client] drain timeout, closing", count, "open streams")
+	}
+	client.Close()
+	logrus.Infoln("[Client] exited")
+}
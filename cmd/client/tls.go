@@ -0,0 +1,86 @@
+package main
+
+import (
+	"anytls/uri"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// newTLSConfig builds the TLS config for one server:
+//   - with ca, the certificate chain is verified against that bundle instead of the system roots
+//   - with pin_sha256, the leaf certificate or its public key must match one of the pins;
+//     without ca the chain itself is not verified, so self-signed certificates work
+//   - otherwise insecure decides between the system roots and no verification
+func newTLSConfig(server clientServer, keyLogWriter io.Writer) (*tls.Config, error) {
+	// You can only use `InsecureSkipVerify` by default in the sample client; it is not recommended for use in production code.
+	insecure := server.Insecure == nil || *server.Insecure
+	tlsConfig := &tls.Config{
+		ServerName:   server.SNI,
+		KeyLogWriter: keyLogWriter,
+	}
+
+	if server.CA != "" {
+		pem, err := os.ReadFile(server.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", server.CA)
+		}
+		insecure = false
+	}
+	if len(server.PinSHA256) > 0 {
+		pins := make([][]byte, 0, len(server.PinSHA256))
+		for _, pin := range server.PinSHA256 {
+			hash, err := uri.ParsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, hash)
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPins(rawCerts, pins)
+		}
+		// the pins replace the chain verification unless a CA bundle is given
+		insecure = server.CA == ""
+	}
+	tlsConfig.InsecureSkipVerify = insecure
+
+	if tlsConfig.ServerName == "" {
+		if insecure {
+			// disable the SNI
+			tlsConfig.ServerName = "127.0.0.1"
+		} else {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(server.Address)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyPins checks the SHA-256 of the leaf certificate and of its
+// SubjectPublicKeyInfo against the pins
+func verifyPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("pin-sha256: no server certificate")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("pin-sha256: %w", err)
+	}
+	certHash := sha256.Sum256(leaf.Raw)
+	spkiHash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(pin, certHash[:]) || bytes.Equal(pin, spkiHash[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("pin-sha256: server certificate %x (public key %x) matches no pin", certHash, spkiHash)
+}
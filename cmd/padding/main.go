@@ -0,0 +1,184 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// traces are synthetic writeConn payload sizes (frame headers included) for
+// the upstream and downstream direction of one proxied connection.
+var traces = map[string][2][]int{
+	// upstream: cmdSettings + cmdSYN + cmdPSH(destination), TLS ClientHello,
+	// ChangeCipherSpec + Finished, HTTP request
+	// downstream: cmdServerSettings, cmdSYNACK, ServerHello ... ServerHelloDone,
+	// NewSessionTicket, HTTP response
+	"https": {{106, 524, 87, 507}, {75, 7, 4007, 293, 16391}},
+	// plain HTTP: the request and the response head and body
+	"http": {{106, 407}, {75, 7, 1207, 16391}},
+}
+
+const usage = `Usage:
+  anytls-padding lint <scheme>
+  anytls-padding simulate [flags] [scheme]
+
+The scheme is a file path, "-" for stdin, or empty for the built-in scheme
+of the direction.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "lint":
+		err = lint(flag.Args()[1:])
+	case "simulate":
+		err = simulate(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func lint(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: anytls-padding lint <scheme>")
+	}
+	rawScheme, err := readScheme(args[0], padding.Upstream)
+	if err != nil {
+		return err
+	}
+	issues := padding.Lint(rawScheme)
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d issue(s) found", len(issues))
+	}
+	fmt.Println("ok, md5", padding.NewPaddingFactory(rawScheme).Md5)
+	return nil
+}
+
+func simulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	direction := fs.String("direction", "up", "Direction to simulate: up (client to server) or down (server to client)")
+	traceSpec := fs.String("trace", "https", "Synthetic trace: https, http or comma separated payload sizes")
+	runs := fs.Int("runs", 1, "Number of runs, random sizes and delays differ between runs")
+	format := fs.String("format", "table", "Output format: table or csv")
+	fs.Parse(args)
+
+	var dir padding.Direction
+	switch *direction {
+	case "up":
+		dir = padding.Upstream
+	case "down":
+		dir = padding.Downstream
+	default:
+		return fmt.Errorf("-direction: expected up or down, got %q", *direction)
+	}
+	trace, err := parseTrace(*traceSpec, dir)
+	if err != nil {
+		return err
+	}
+	if *format != "table" && *format != "csv" {
+		return fmt.Errorf("-format: expected table or csv, got %q", *format)
+	}
+	if fs.NArg() > 1 {
+		return errors.New("usage: anytls-padding simulate [flags] [scheme]")
+	}
+
+	rawScheme, err := readScheme(fs.Arg(0), dir)
+	if err != nil {
+		return err
+	}
+	for _, issue := range padding.Lint(rawScheme) {
+		fmt.Fprintln(os.Stderr, "warning:", issue)
+	}
+	p := padding.NewPaddingFactory(rawScheme)
+	if p == nil {
+		return errors.New("invalid padding scheme")
+	}
+	p = p.ForDirection(dir)
+
+	rows := [][]string{{"run", "write", "packet", "record", "size", "payload", "padding", "delay"}}
+	for run := 1; run <= *runs; run++ {
+		record := 0
+		lastWrite := -2
+		for _, r := range session.SimulateWrites(p, dir, trace) {
+			if r.Write != lastWrite {
+				record, lastWrite = 0, r.Write
+			}
+			record++
+			write := strconv.Itoa(r.Write)
+			if r.Write < 0 {
+				write = "auth"
+			}
+			rows = append(rows, []string{
+				strconv.Itoa(run),
+				write,
+				strconv.FormatUint(uint64(r.Packet), 10),
+				strconv.Itoa(record),
+				strconv.Itoa(r.Size),
+				strconv.Itoa(r.Payload),
+				strconv.Itoa(r.Padding),
+				r.Delay.String(),
+			})
+		}
+	}
+
+	if *format == "csv" {
+		w := csv.NewWriter(os.Stdout)
+		w.WriteAll(rows)
+		return w.Error()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t")+"\t")
+	}
+	return w.Flush()
+}
+
+func readScheme(path string, dir padding.Direction) ([]byte, error) {
+	switch path {
+	case "":
+		if dir == padding.Downstream {
+			return padding.DefaultDownstreamPaddingFactory.Load().RawScheme, nil
+		}
+		return padding.DefaultPaddingFactory.Load().RawScheme, nil
+	case "-":
+		return io.ReadAll(os.Stdin)
+	default:
+		return os.ReadFile(path)
+	}
+}
+
+func parseTrace(spec string, dir padding.Direction) ([]int, error) {
+	if t, ok := traces[spec]; ok {
+		return t[dir], nil
+	}
+	var trace []int
+	for _, s := range strings.Split(spec, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("-trace: %q is not a positive size", s)
+		}
+		trace = append(trace, n)
+	}
+	return trace, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"anytls/util"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminServer 是本地管理接口（HTTP JSON），只允许监听 Unix socket 或回环地址
+type adminServer struct {
+	server *myServer
+	// router 是 SNI 路由表，未配置时为 nil
+	router *sniRouter
+	// paddingSchemePath 是 --padding-scheme 指定的文件，用于重载填充方案
+	paddingSchemePath string
+	// downstreamPaddingSchemePath 是 --downstream-padding-scheme 指定的文件
+	downstreamPaddingSchemePath string
+}
+
+// adminSession 是 GET /sessions 返回的会话信息
+type adminSession struct {
+	ID     uint64 `json:"id"`
+	UserID int    `json:"user_id"`
+	// User 是用户名，仅用户文件与 Webhook 模式下有值
+	User   string `json:"user,omitempty"`
+	Remote string `json:"remote"`
+	// Streams 是当前打开的 Stream 数
+	Streams int `json:"streams"`
+	// Age 是会话已存在的秒数
+	Age float64 `json:"age"`
+	// Upload / Download 是该会话上已结束的 Stream 累计的字节数
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// listenAdmin 监听管理接口地址：unix:/path/to/socket 或 127.0.0.1:port
+func listenAdmin(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// 删除上次运行残留的 socket 文件
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		return listenAdminUnix(path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("管理接口只能监听 unix socket 或回环地址: %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenAdminUnix 先在 0700 的临时目录中创建 socket 并改为 0600，再移动到 path，
+// 避免 socket 在修改权限之前可以被其他本地用户连接
+func listenAdminUnix(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".anytls-admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// socket 移动之后由 adminUnixListener 在关闭时删除
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmpPath, 0o600); err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return adminUnixListener{Listener: l, path: path}, nil
+}
+
+// adminUnixListener 在关闭时删除 socket 文件
+type adminUnixListener struct {
+	net.Listener
+	path string
+}
+
+func (l adminUnixListener) Close() error {
+	err := l.Listener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+// serve 在 l 上运行管理接口，阻塞直到监听关闭
+func (a *adminServer) serve(l net.Listener) error {
+	srv := &http.Server{
+		Handler:           a.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return srv.Serve(l)
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.listSessions)
+	mux.HandleFunc("POST /sessions/{id}/close", a.closeSession)
+	mux.HandleFunc("POST /users/{id}/close", a.closeUser)
+	mux.HandleFunc("GET /users", a.userStats)
+	mux.HandleFunc("GET /cert", a.certInfo)
+	mux.HandleFunc("POST /padding/reload", a.reloadPadding)
+	mux.HandleFunc("POST /v2board/pull", a.v2boardPull)
+	mux.HandleFunc("POST /v2board/push", a.v2boardPush)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// GET /sessions 列出所有存活的会话
+func (a *adminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	entries := a.server.sessions.list()
+	result := make([]adminSession, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, adminSession{
+			ID:       entry.id,
+			UserID:   entry.userID,
+			User:     entry.sess.User.Name,
+			Remote:   entry.remote.String(),
+			Streams:  entry.sess.StreamCount(),
+			Age:      now.Sub(entry.created).Seconds(),
+			Upload:   entry.upload.Load(),
+			Download: entry.download.Load(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	writeJSON(w, http.StatusOK, result)
+}
+
+// POST /sessions/{id}/close 关闭单个会话
+func (a *adminServer) closeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entry, ok := a.server.sessions.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+	go entry.sess.Alert("session closed by administrator")
+	logrus.Infoln("[Admin] 关闭会话:", id, entry.remote)
+	writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+}
+
+// POST /users/{id}/close 关闭某个用户的所有会话
+func (a *adminServer) closeUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	count := a.server.sessions.kickUsers([]int{userID}, "session closed by administrator")
+	writeJSON(w, http.StatusOK, map[string]int{"closed": count})
+}
+
+// GET /users 返回当前用户表大小（Webhook 模式下为 -1）与在线用户数
+func (a *adminServer) userStats(w http.ResponseWriter, r *http.Request) {
+	users := a.server.userCount()
+	writeJSON(w, http.StatusOK, map[string]int{
+		"users":        users,
+		"online_users": a.server.sessions.userCount(),
+	})
+}
+
+// adminCert 是 GET /cert 返回的证书信息
+type adminCert struct {
+	Subject   string    `json:"subject"`
+	Names     []string  `json:"names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// SHA256 与 SPKISHA256 可以直接用作客户端的 pin-sha256
+	SHA256     string `json:"sha256"`
+	SPKISHA256 string `json:"spki_sha256"`
+}
+
+// GET /cert 返回当前使用的服务器证书及其指纹
+func (a *adminServer) certInfo(w http.ResponseWriter, r *http.Request) {
+	cert, err := a.server.tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	info := adminCert{
+		Subject:   leaf.Subject.String(),
+		Names:     certNames(leaf),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+	info.SHA256, info.SPKISHA256 = util.CertFingerprints(leaf)
+	writeJSON(w, http.StatusOK, info)
+}
+
+// adminPaddingReload 是 POST /padding/reload 的返回值
+type adminPaddingReload struct {
+	// MD5 是全局方案的 md5
+	MD5 string `json:"md5"`
+	// SNIRoutes 是使用自己方案文件的 SNI 路由重新加载后的 md5
+	SNIRoutes map[string]string `json:"sni_routes,omitempty"`
+	// Skipped 是没有重新加载的 SNI 路由及原因
+	Skipped map[string]string `json:"skipped,omitempty"`
+	// Note 说明重新加载的方案暂时不会生效的原因
+	Note string `json:"note,omitempty"`
+}
+
+// POST /padding/reload 重新加载填充方案。请求体不为空时使用请求体作为新方案，
+// 否则重新读取 --padding-scheme 文件；?direction=downstream 时重载下行方案。
+// 重新读取文件时，使用自己方案文件的 SNI 路由也一并重新加载。
+func (a *adminServer) reloadPadding(w http.ResponseWriter, r *http.Request) {
+	schemePath, flagName := a.paddingSchemePath, "--padding-scheme"
+	update, factory := padding.UpdatePaddingScheme, &padding.DefaultPaddingFactory
+	direction := r.URL.Query().Get("direction")
+	switch direction {
+	case "":
+		direction = "upstream"
+	case "upstream":
+	case "downstream":
+		schemePath, flagName = a.downstreamPaddingSchemePath, "--downstream-padding-scheme"
+		update, factory = padding.UpdateDownstreamPaddingScheme, &padding.DefaultDownstreamPaddingFactory
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("direction must be upstream or downstream"))
+		return
+	}
+
+	rawScheme, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// SNI 路由共用全局的下行方案，只有上行方案可能有自己的文件
+	var routes []*sniRoute
+	if a.router != nil && direction == "upstream" {
+		for _, route := range a.router.routes {
+			if route.paddingScheme != "" {
+				routes = append(routes, route)
+			}
+		}
+	}
+
+	fromBody := len(rawScheme) > 0
+	var result adminPaddingReload
+	switch {
+	case fromBody:
+	case schemePath != "":
+		if rawScheme, err = os.ReadFile(schemePath); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	case len(routes) > 0:
+		result.Note = flagName + " is not set, the global scheme is unchanged"
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("no padding scheme in request body and "+flagName+" is not set"))
+		return
+	}
+	if len(rawScheme) > 0 {
+		if !update(rawScheme) {
+			writeError(w, http.StatusBadRequest, errors.New("invalid padding scheme"))
+			return
+		}
+		logrus.Infoln("[Admin] 填充方案已重新加载:", direction, factory.Load().Md5)
+	}
+	result.MD5 = factory.Load().Md5
+
+	if direction == "downstream" {
+		if a.server.downstreamPadding == nil {
+			result.Note = "downstream padding is disabled, the scheme applies once it is enabled with --downstream-padding"
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	for _, route := range routes {
+		name := strings.Join(route.serverNames, ",")
+		if fromBody {
+			setMapValue(&result.Skipped, name, "the request body only replaces the global scheme")
+			continue
+		}
+		md5, err := route.reloadPadding()
+		if err != nil {
+			logrus.Errorln("[Admin] SNI 路由", name, "的填充方案重新加载失败:", err)
+			setMapValue(&result.Skipped, name, err.Error())
+			continue
+		}
+		logrus.Infoln("[Admin] SNI 路由", name, "的填充方案已重新加载:", md5)
+		setMapValue(&result.SNIRoutes, name, md5)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// setMapValue 在 *m 为 nil 时先创建 map
+func setMapValue(m *map[string]string, key, value string) {
+	if *m == nil {
+		*m = make(map[string]string)
+	}
+	(*m)[key] = value
+}
+
+// POST /v2board/pull 立即拉取用户列表
+func (a *adminServer) v2boardPull(w http.ResponseWriter, r *http.Request) {
+	if a.server.v2boardAuth == nil {
+		writeError(w, http.StatusBadRequest, errors.New("not in V2board mode"))
+		return
+	}
+	if err := a.server.v2boardAuth.Refresh(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"users": a.server.v2boardAuth.UserCount()})
+}
+
+// POST /v2board/push 立即上报流量
+func (a *adminServer) v2boardPush(w http.ResponseWriter, r *http.Request) {
+	if a.server.v2boardTraffic == nil {
+		writeError(w, http.StatusBadRequest, errors.New("not in V2board mode"))
+		return
+	}
+	if err := a.server.v2boardTraffic.Push(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
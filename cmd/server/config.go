@@ -0,0 +1,230 @@
+package main
+
+import (
+	"anytls/util"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// serverConfig 是 -c 指定的配置文件结构（YAML 或 JSON），涵盖全部命令行参数。
+// 命令行中显式指定的参数优先于配置文件。
+type serverConfig struct {
+	// Listeners 是监听地址列表，对应 -l；V2board 模式下未配置时使用面板下发的端口
+	Listeners []string           `yaml:"listeners" json:"listeners"`
+	TLS       serverTLSConfig    `yaml:"tls" json:"tls"`
+	Auth      serverAuthConfig   `yaml:"auth" json:"auth"`
+	Padding   serverPadding      `yaml:"padding" json:"padding"`
+	Outbound  serverOutboundConf `yaml:"outbound" json:"outbound"`
+	// Fallback 对应 --fallback
+	Fallback string `yaml:"fallback" json:"fallback"`
+	// Metrics 对应 --metrics
+	Metrics string `yaml:"metrics" json:"metrics"`
+	// Admin 对应 --admin
+	Admin string `yaml:"admin" json:"admin"`
+	// Heartbeat 是会话的主动保活
+	Heartbeat heartbeatConfig `yaml:"heartbeat" json:"heartbeat"`
+	// DrainTimeout 是收到 SIGTERM / SIGINT 后等待存量 Stream 结束的最长时间，对应 --drain-timeout；
+	// 未配置时使用参数默认值，0 表示不等待
+	DrainTimeout *util.Duration `yaml:"drain_timeout" json:"drain_timeout"`
+}
+
+type serverTLSConfig struct {
+	// Cert / Key 对应 --cert / --key
+	Cert string `yaml:"cert" json:"cert"`
+	Key  string `yaml:"key" json:"key"`
+	// SelfSigned 是未指定 Cert 时使用的持久化自签名证书
+	SelfSigned selfSignedConfig `yaml:"self_signed" json:"self_signed"`
+	// SNI 是内联的 SNI 路由表，与 --sni-routes 文件格式相同
+	SNI *sniRoutesConfig `yaml:"sni" json:"sni"`
+}
+
+type selfSignedConfig struct {
+	// Dir 是保存私钥与证书的状态目录，对应 --cert-dir；留空时每次启动生成临时证书
+	Dir string `yaml:"dir" json:"dir"`
+	// KeyType 是 ecdsa（P-256，默认）或 ed25519，对应 --cert-key-type
+	KeyType string `yaml:"key_type" json:"key_type"`
+	// Names 是证书的 SAN（域名或 IP），第一个域名同时作为 CN，对应 --cert-names
+	Names []string `yaml:"names" json:"names"`
+	// Validity 是证书有效期，对应 --cert-validity，默认 8760h（一年）
+	Validity util.Duration `yaml:"validity" json:"validity"`
+	// RenewBefore 是到期前多久重新签发证书，默认为有效期的 1/3
+	RenewBefore util.Duration `yaml:"renew_before" json:"renew_before"`
+}
+
+type serverAuthConfig struct {
+	// Password 对应 -p（普通密码模式）
+	Password string `yaml:"password" json:"password"`
+	// UsersFile 对应 --users-file（用户文件模式）
+	UsersFile string        `yaml:"users_file" json:"users_file"`
+	Webhook   webhookConfig `yaml:"webhook" json:"webhook"`
+	V2board   v2boardConfig `yaml:"v2board" json:"v2board"`
+}
+
+type webhookConfig struct {
+	// URL 对应 --auth-webhook（Webhook 模式）
+	URL string `yaml:"url" json:"url"`
+	// Token 对应 --auth-webhook-token，以 Authorization: Bearer 发送
+	Token string `yaml:"token" json:"token"`
+	// CacheTTL 是认证结果的缓存时间，对应 --auth-webhook-cache-ttl，默认 60s，0 表示不缓存
+	CacheTTL *util.Duration `yaml:"cache_ttl" json:"cache_ttl"`
+}
+
+type v2boardConfig struct {
+	APIHost string `yaml:"api_host" json:"api_host"`
+	APIKey  string `yaml:"api_key" json:"api_key"`
+	NodeID  uint   `yaml:"node_id" json:"node_id"`
+	// PullInterval / PushInterval 为 0 时使用面板下发的周期，面板未下发则为 60s
+	PullInterval util.Duration `yaml:"pull_interval" json:"pull_interval"`
+	PushInterval util.Duration `yaml:"push_interval" json:"push_interval"`
+}
+
+// enabled 判断是否配置了任意一项 V2board 参数
+func (c *v2boardConfig) enabled() bool {
+	return c.APIHost != "" || c.APIKey != "" || c.NodeID != 0
+}
+
+type heartbeatConfig struct {
+	// Interval 是会话静默多久后发送 cmdHeartRequest，对应 --heartbeat-interval，0 表示不主动发送心跳
+	Interval *util.Duration `yaml:"interval" json:"interval"`
+	// Timeout 是等待 cmdHeartResponse 的时间，超时关闭会话，对应 --heartbeat-timeout
+	Timeout *util.Duration `yaml:"timeout" json:"timeout"`
+}
+
+type serverPadding struct {
+	// Scheme 是填充方案文件，对应 --padding-scheme
+	Scheme string `yaml:"scheme" json:"scheme"`
+	// DownstreamEnabled 填充服务器发往客户端方向的流量，对应 --downstream-padding，默认不填充
+	DownstreamEnabled bool `yaml:"downstream_enabled" json:"downstream_enabled"`
+	// Downstream 是下行填充方案文件，对应 --downstream-padding-scheme；
+	// 留空使用内置方案，指定时同时启用下行填充
+	Downstream string `yaml:"downstream" json:"downstream"`
+}
+
+type serverOutboundConf struct {
+	// DialTimeout 是出站 TCP 连接的超时时间，默认 5s
+	DialTimeout util.Duration `yaml:"dial_timeout" json:"dial_timeout"`
+	// Outbounds 是供规则引用的具名出站，direct 与 reject 为内置出站
+	Outbounds []outboundConfig `yaml:"outbounds" json:"outbounds"`
+	// Rules 按顺序匹配，第一条匹配的规则生效
+	Rules []outboundRuleConfig `yaml:"rules" json:"rules"`
+	// Final 是没有规则匹配时使用的出站，默认 direct
+	Final string `yaml:"final" json:"final"`
+}
+
+type outboundConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Type 是 direct（默认）、socks5 或 http
+	Type string `yaml:"type" json:"type"`
+	// Server 是上游代理地址 host:port，Username / Password 可选
+	Server   string `yaml:"server" json:"server"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// Bind 是发起连接使用的本地 IP（连接上游代理时同样生效）
+	Bind string `yaml:"bind" json:"bind"`
+}
+
+type outboundRuleConfig struct {
+	DomainSuffix  []string `yaml:"domain_suffix" json:"domain_suffix"`
+	DomainKeyword []string `yaml:"domain_keyword" json:"domain_keyword"`
+	DomainRegex   []string `yaml:"domain_regex" json:"domain_regex"`
+	// IPCIDR 同时匹配域名目标解析出的地址
+	IPCIDR []string `yaml:"ip_cidr" json:"ip_cidr"`
+	// Port 是端口或端口范围，如 25、8000-9000
+	Port []string `yaml:"port" json:"port"`
+	User []int    `yaml:"user" json:"user"`
+	// Network 是 tcp 或 udp，留空匹配两者
+	Network  string `yaml:"network" json:"network"`
+	Outbound string `yaml:"outbound" json:"outbound"`
+}
+
+// validate 检查配置的完整性，错误信息中包含出错的配置项名称
+func (c *serverConfig) validate() error {
+	for i, listen := range c.Listeners {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls.cert 与 tls.key（--cert / --key）必须同时指定")
+	}
+	if ss := c.TLS.SelfSigned; ss.Dir != "" {
+		if c.TLS.Cert != "" {
+			return errors.New("tls.cert 与 tls.self_signed.dir（--cert / --cert-dir）只能指定一个")
+		}
+		if ss.KeyType != "" && ss.KeyType != "ecdsa" && ss.KeyType != "ed25519" {
+			return fmt.Errorf("tls.self_signed.key_type: 不支持的私钥类型 %s（可选 ecdsa、ed25519）", ss.KeyType)
+		}
+		if ss.Validity < 0 {
+			return errors.New("tls.self_signed.validity: 不能为负数")
+		}
+		if ss.RenewBefore < 0 || (ss.Validity > 0 && ss.RenewBefore >= ss.Validity) {
+			return errors.New("tls.self_signed.renew_before: 必须小于有效期")
+		}
+	}
+
+	var modes []string
+	if c.Auth.Password != "" {
+		modes = append(modes, "auth.password")
+	}
+	if c.Auth.UsersFile != "" {
+		modes = append(modes, "auth.users_file")
+	}
+	if c.Auth.Webhook.URL != "" {
+		modes = append(modes, "auth.webhook")
+	}
+	v2b := &c.Auth.V2board
+	if v2b.enabled() {
+		modes = append(modes, "auth.v2board")
+	}
+	if len(modes) > 1 {
+		return fmt.Errorf("%s 互斥，只能选择一种认证方式", strings.Join(modes, "、"))
+	}
+	if len(modes) == 0 {
+		return errors.New("auth: 请通过 -p 指定密码，或使用 --users-file、--auth-webhook、--v2board-* 参数选择认证方式")
+	}
+
+	if c.Auth.Webhook.URL != "" {
+		u, err := url.Parse(c.Auth.Webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("auth.webhook.url（--auth-webhook）必须是 http:// 或 https:// 地址")
+		}
+		if ttl := c.Auth.Webhook.CacheTTL; ttl != nil && *ttl < 0 {
+			return errors.New("auth.webhook.cache_ttl 不能为负数")
+		}
+	}
+
+	if v2b.enabled() {
+		switch {
+		case v2b.APIHost == "":
+			return errors.New("auth.v2board.api_host（--v2board-api-host）不能为空")
+		case v2b.APIKey == "":
+			return errors.New("auth.v2board.api_key（--v2board-api-key）不能为空")
+		case v2b.NodeID == 0:
+			return errors.New("auth.v2board.node_id（--v2board-node-id）不能为空")
+		}
+		if v2b.PullInterval < 0 {
+			return errors.New("auth.v2board.pull_interval 不能为负数")
+		}
+		if v2b.PushInterval < 0 {
+			return errors.New("auth.v2board.push_interval 不能为负数")
+		}
+	}
+
+	if c.Outbound.DialTimeout < 0 {
+		return errors.New("outbound.dial_timeout 不能为负数")
+	}
+	if d := c.Heartbeat.Interval; d != nil && *d < 0 {
+		return errors.New("heartbeat.interval（--heartbeat-interval）不能为负数")
+	}
+	if d := c.Heartbeat.Timeout; d != nil && *d <= 0 {
+		return errors.New("heartbeat.timeout（--heartbeat-timeout）必须大于 0")
+	}
+	if d := c.DrainTimeout; d != nil && *d < 0 {
+		return errors.New("drain_timeout（--drain-timeout）不能为负数")
+	}
+	return nil
+}
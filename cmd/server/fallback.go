@@ -0,0 +1,177 @@
+package main
+
+import (
+	"anytls/proxy"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fallbackFunc 接管一个认证失败的连接。c 已被回绕，读取时会先得到客户端发来的原始首包。
+// 该函数应阻塞直到连接处理完毕，返回后连接会被关闭。
+type fallbackFunc func(ctx context.Context, c net.Conn)
+
+// newFallback 根据 --fallback 参数创建 fallback 处理器，支持以下格式：
+//   - tcp://host:port 或 http://host:port：将连接原样转发到上游（例如本地 nginx 的 HTTP 端口）
+//   - host:port：同 tcp://host:port
+//   - file:///var/www/html：使用内置 HTTP 服务器提供该目录下的静态文件
+//   - static：使用内置 HTTP 服务器提供一个默认的静态页面
+func newFallback(spec string) (fallbackFunc, error) {
+	if spec == "static" {
+		return newStaticFallback(http.HandlerFunc(defaultSiteHandler)), nil
+	}
+
+	if !strings.Contains(spec, "://") {
+		if _, _, err := net.SplitHostPort(spec); err != nil {
+			return nil, fmt.Errorf("无法识别的 fallback 地址 %q: %w", spec, err)
+		}
+		return newForwardFallback(spec), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("解析 fallback 地址 %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "tcp", "http":
+		addr := u.Host
+		if u.Port() == "" {
+			if u.Scheme != "http" {
+				return nil, fmt.Errorf("fallback 地址 %q 缺少端口", spec)
+			}
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		return newForwardFallback(addr), nil
+	case "file":
+		fi, err := os.Stat(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("fallback 静态目录: %w", err)
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("fallback 静态路径 %q 不是目录", u.Path)
+		}
+		return newStaticFallback(http.FileServer(http.Dir(u.Path))), nil
+	default:
+		return nil, fmt.Errorf("不支持的 fallback 协议: %s", u.Scheme)
+	}
+}
+
+// newForwardFallback 将连接（含已读出的首包）转发到 TCP 上游
+func newForwardFallback(addr string) fallbackFunc {
+	return func(ctx context.Context, c net.Conn) {
+		remote, err := proxy.SystemDialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			logrus.Debugln("fallback DialContext:", err)
+			return
+		}
+		defer remote.Close()
+		copyBidirectional(ctx, c, remote, nil)
+	}
+}
+
+// newStaticFallback 在单个连接上运行内置 HTTP 服务器
+func newStaticFallback(handler http.Handler) fallbackFunc {
+	return func(ctx context.Context, c net.Conn) {
+		srv := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       30 * time.Second,
+			ErrorLog:          log.New(io.Discard, "", 0),
+		}
+		// Serve 在连接关闭后返回
+		_ = srv.Serve(newSingleConnListener(c))
+	}
+}
+
+// defaultSiteHandler 是内置的默认站点，外观与一个刚装好的 Web 服务器相同
+func defaultSiteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = io.WriteString(w, defaultSitePage)
+}
+
+const defaultSitePage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome</title>
+<style>
+html { color-scheme: light dark; }
+body { width: 35em; margin: 0 auto; font-family: Tahoma, Verdana, Arial, sans-serif; }
+</style>
+</head>
+<body>
+<h1>Welcome</h1>
+<p>If you see this page, the web server is successfully installed and working.</p>
+</body>
+</html>
+`
+
+// singleConnListener 是只返回一个连接的 net.Listener，
+// 用于在 fallback 连接上直接运行 http.Server
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newSingleConnListener(c net.Conn) *singleConnListener {
+	l := &singleConnListener{closed: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: c, onClose: l.close}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	// 第二次 Accept 阻塞到连接关闭，之后 http.Server.Serve 返回
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) close() {
+	l.once.Do(func() { close(l.closed) })
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "fallback" }
+func (dummyAddr) String() string  { return "fallback" }
+
+// notifyCloseConn 在连接关闭时通知 singleConnListener
+type notifyCloseConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
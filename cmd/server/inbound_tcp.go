@@ -1,115 +1,77 @@
 package main
 
 import (
-	"anytls/proxy/padding"
-	"anytls/proxy/session"
+	"anytls"
+	"anytls/auth"
 	"context"
-	"crypto/tls"
-	"encoding/binary"
+	"errors"
 	"net"
-	"runtime/debug"
 	"strings"
 
-	"github.com/sagernet/sing/common/buf"
-	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
 	"github.com/sirupsen/logrus"
 )
 
-// handleTcpConnection 处理一个入站 TCP 连接的完整生命周期：
-// TLS 握手 -> 认证 -> 会话复用 -> 代理请求
-func handleTcpConnection(ctx context.Context, c net.Conn, s *myServer) {
-	defer func() {
-		if r := recover(); r != nil {
-			logrus.Errorln("[BUG]", r, string(debug.Stack()))
-		}
-	}()
-
-	// TLS 握手
-	c = tls.Server(c, s.tlsConfig)
-	defer c.Close()
-
-	// 读取首个数据包（包含认证信息）
-	b := buf.NewPacket()
-	defer b.Release()
-
-	n, err := b.ReadOnceFrom(c)
-	if err != nil {
-		logrus.Debugln("ReadOnceFrom:", err)
-		return
-	}
-	c = bufio.NewCachedConn(c, b)
+// serveConn 处理一个入站 TCP 连接的完整生命周期：
+// TLS 握手 -> 认证 -> 会话复用 -> 代理请求，前三步由 anytls.Server 完成
+func (s *myServer) serveConn(ctx context.Context, c net.Conn) {
+	s.server.ServeConn(ctx, c)
+}
 
-	// 读取并验证 sha256(password/uuid)（32 字节）
-	passwordHashBytes, err := b.ReadBytes(32)
-	if err != nil || !isValidAuth(passwordHashBytes, s, n, c, b) {
-		return
+// Authenticate 实现 auth.Authenticator：交给配置的认证器，失败时计入指标，随后由 anytls.Server 执行 fallback
+func (s *myServer) Authenticate(passwordHash []byte) (auth.User, bool) {
+	user, ok := s.authenticator.Authenticate(passwordHash)
+	if !ok {
+		metricAuthFailures.Inc()
 	}
+	return user, ok
+}
 
-	// 读取并丢弃 padding0（认证阶段填充）
-	paddingLenBytes, err := b.ReadBytes(2)
-	if err != nil {
-		b.Resize(0, n)
-		fallback(ctx, c)
-		return
-	}
-	paddingLen := binary.BigEndian.Uint16(paddingLenBytes)
-	if paddingLen > 0 {
-		if _, err = b.ReadBytes(int(paddingLen)); err != nil {
-			b.Resize(0, n)
-			fallback(ctx, c)
-			return
-		}
+// onSession 在会话认证成功后、处理 Stream 之前执行：在线 IP 登记、设备数限制与会话登记
+func (s *myServer) onSession(sess *anytls.Session) error {
+	remoteIP := M.SocksaddrFromNet(sess.RemoteAddr).Addr.String()
+	release, ok := s.acquireOnline(sess.User.ID, remoteIP)
+	if !ok {
+		logrus.Infoln("设备数超过限制，拒绝会话:", sess.User.ID, remoteIP)
+		return errors.New("device limit exceeded")
 	}
+	entry := s.sessions.add(sess.User.ID, sess.RemoteAddr, sess)
+	entry.release = release
+	entry.limiter = s.speedLimiter(sess.User.ID)
+	sess.Value = entry
+	return nil
+}
 
-	// 认证成功，查找用户 ID 并记录（用于流量统计）
-	userID, _ := s.authenticate(passwordHashBytes)
-
-	// 建立会话层，在每个新 Stream 上执行代理逻辑
-	sess := session.NewServerSession(c, func(stream *session.Stream) {
-		defer func() {
-			if r := recover(); r != nil {
-				logrus.Errorln("[BUG]", r, string(debug.Stack()))
-			}
-		}()
-		defer stream.Close()
-
-		// 解析代理目标地址（SocksAddr 格式）
-		destination, err := M.SocksaddrSerializer.ReadAddrPort(stream)
-		if err != nil {
-			logrus.Debugln("ReadAddrPort:", err)
-			return
-		}
-
-		var upload, download int64
-		if strings.Contains(destination.String(), "udp-over-tcp.arpa") {
-			upload, download = proxyOutboundUoT(ctx, stream, destination)
-		} else {
-			upload, download = proxyOutboundTCP(ctx, stream, destination)
-		}
-
-		// 记录本次代理的流量
-		s.recordTraffic(userID, upload, download)
-	}, &padding.DefaultPaddingFactory)
-
-	sess.Run()
-	sess.Close()
+// onSessionClosed 在会话结束且全部 Stream 处理函数完成流量记账后注销，优雅退出依赖这一点
+func (s *myServer) onSessionClosed(sess *anytls.Session) {
+	entry := sess.Value.(*sessionEntry)
+	s.sessions.remove(entry)
+	entry.release()
 }
 
-// isValidAuth 验证认证哈希并在失败时执行 fallback，避免重复代码
-func isValidAuth(passwordHashBytes []byte, s *myServer, n int, c net.Conn, b *buf.Buffer) bool {
-	ctx := context.Background()
-	_, ok := s.authenticate(passwordHashBytes)
-	if !ok {
-		b.Resize(0, n)
-		fallback(ctx, c)
-		return false
+// handleStream 在每个新 Stream 上执行代理逻辑
+func (s *myServer) handleStream(ctx context.Context, sess *anytls.Session, stream net.Conn, destination M.Socksaddr) {
+	entry := sess.Value.(*sessionEntry)
+
+	var upload, download int64
+	if strings.Contains(destination.String(), "udp-over-tcp.arpa") {
+		upload, download = proxyOutboundUoT(ctx, stream, destination, s.outbound, sess.User.ID, entry.limiter)
+	} else {
+		upload, download = proxyOutboundTCP(ctx, stream, destination, s.outbound, sess.User.ID, entry.limiter)
 	}
-	return true
+
+	// 记录本次代理的流量
+	entry.upload.Add(upload)
+	entry.download.Add(download)
+	s.recordTraffic(sess.User.ID, upload, download)
 }
 
-// fallback 处理认证失败的连接（当前为简单关闭，可扩展为 HTTP fallback）
-func fallback(ctx context.Context, c net.Conn) {
-	// 暂未实现 HTTP fallback
+// fallback 处理认证失败的连接：未配置 --fallback 时直接关闭，
+// 否则交给 fallback 处理器，使探测方看到一个普通的 HTTPS 网站
+func (s *myServer) fallback(ctx context.Context, c net.Conn) {
 	logrus.Debugln("fallback:", c.RemoteAddr())
+	metricFallbacks.Inc()
+	if s.fallbackFunc != nil {
+		s.fallbackFunc(ctx, c)
+	}
 }
@@ -1,27 +1,64 @@
 package main
 
 import (
+	"anytls/auth"
+	"anytls/metrics"
+	"anytls/proxy"
 	"anytls/proxy/padding"
 	"anytls/util"
 	"anytls/v2board"
 	"context"
-	"crypto/sha256"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// certCheckInterval 是检查证书文件是否变化的周期
+	certCheckInterval = 10 * time.Second
+	// usersFileCheckInterval 是检查 --users-file 是否变化的周期
+	usersFileCheckInterval = 10 * time.Second
+)
+
 func main() {
+	configPath := flag.String("c", "", "配置文件（.yaml / .yml / .json），命令行中显式指定的参数优先")
+
 	// ---- 通用参数 ----
 	listen := flag.String("l", "0.0.0.0:8443", "server listen port")
 	password := flag.String("p", "", "password (used in plain mode)")
 	paddingScheme := flag.String("padding-scheme", "", "padding-scheme file path")
+	downstreamPadding := flag.Bool("downstream-padding", false, "填充下行（服务器 -> 客户端）流量，默认不填充")
+	downstreamPaddingScheme := flag.String("downstream-padding-scheme", "", "下行填充方案文件，留空使用内置方案，指定时同时启用下行填充")
+	certFile := flag.String("cert", "", "TLS 证书链文件（PEM），留空则使用自签名证书")
+	keyFile := flag.String("key", "", "TLS 私钥文件（PEM）")
+	certDir := flag.String("cert-dir", "", "自签名证书的状态目录，私钥只生成一次，证书到期前自动轮换")
+	certKeyType := flag.String("cert-key-type", "ecdsa", "自签名证书的私钥类型：ecdsa 或 ed25519")
+	certNames := flag.String("cert-names", "", "自签名证书的 SAN（域名或 IP），逗号分隔")
+	certValidity := flag.Duration("cert-validity", 365*24*time.Hour, "自签名证书的有效期")
+	sniRoutes := flag.String("sni-routes", "", "SNI 路由表（JSON 文件），按 SNI 分发到不同的 AnyTLS 服务或上游")
+	adminAddr := flag.String("admin", "", "本地管理接口监听地址（unix:/run/anytls.sock 或 127.0.0.1:port），留空不启用")
+	metricsAddr := flag.String("metrics", "", "Prometheus 指标监听地址（如 127.0.0.1:9100），留空不启用")
+	fallbackSpec := flag.String("fallback", "", "认证失败时的 fallback：tcp://host:port、http://host:port、file:///dir 或 static")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "收到 SIGTERM / SIGINT 后等待存量连接结束的最长时间")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 60*time.Second, "会话静默多久后发送心跳")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 10*time.Second, "心跳无响应多久后关闭会话")
+	printURI := flag.Bool("print-uri", false, "输出每个用户的 anytls:// 分享链接与二维码后退出")
+	uriHost := flag.String("uri-host", "", "分享链接中的服务器域名或 IP，留空使用监听地址")
+
+	// ---- 其它认证方式 ----
+	usersFile := flag.String("users-file", "", "多用户文件，每行：用户名 密码 [流量配额，如 100GiB]，修改后自动重载")
+	authWebhook := flag.String("auth-webhook", "", "认证 Webhook 地址，对每个新的密码哈希发送 POST 请求")
+	authWebhookToken := flag.String("auth-webhook-token", "", "认证 Webhook 的 Bearer Token")
+	authWebhookCacheTTL := flag.Duration("auth-webhook-cache-ttl", 60*time.Second, "认证 Webhook 结果的缓存时间")
 
 	// ---- V2board 参数 ----
 	v2boardApiHost := flag.String("v2board-api-host", "", "V2board 面板地址，如 https://panel.example.com")
@@ -39,104 +76,372 @@ func main() {
 	}
 	logrus.SetLevel(logLevel)
 
-	// ---- 填充方案（可选） ----
-	if *paddingScheme != "" {
-		f, err := os.Open(*paddingScheme)
+	// ---- 配置文件（可选），命令行中显式指定的参数覆盖配置文件 ----
+	cfg := &serverConfig{}
+	if *configPath != "" {
+		if err := util.LoadConfigFile(*configPath, cfg); err != nil {
+			logrus.Fatalln("加载配置文件失败:", err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "l":
+			cfg.Listeners = []string{*listen}
+		case "p":
+			cfg.Auth.Password = *password
+		case "padding-scheme":
+			cfg.Padding.Scheme = *paddingScheme
+		case "downstream-padding":
+			cfg.Padding.DownstreamEnabled = *downstreamPadding
+		case "downstream-padding-scheme":
+			cfg.Padding.Downstream = *downstreamPaddingScheme
+		case "cert":
+			cfg.TLS.Cert = *certFile
+		case "key":
+			cfg.TLS.Key = *keyFile
+		case "cert-dir":
+			cfg.TLS.SelfSigned.Dir = *certDir
+		case "cert-key-type":
+			cfg.TLS.SelfSigned.KeyType = *certKeyType
+		case "cert-names":
+			cfg.TLS.SelfSigned.Names = strings.Split(*certNames, ",")
+		case "cert-validity":
+			cfg.TLS.SelfSigned.Validity = util.Duration(*certValidity)
+		case "admin":
+			cfg.Admin = *adminAddr
+		case "metrics":
+			cfg.Metrics = *metricsAddr
+		case "fallback":
+			cfg.Fallback = *fallbackSpec
+		case "drain-timeout":
+			cfg.DrainTimeout = (*util.Duration)(drainTimeout)
+		case "heartbeat-interval":
+			cfg.Heartbeat.Interval = (*util.Duration)(heartbeatInterval)
+		case "heartbeat-timeout":
+			cfg.Heartbeat.Timeout = (*util.Duration)(heartbeatTimeout)
+		case "users-file":
+			cfg.Auth.UsersFile = *usersFile
+		case "auth-webhook":
+			cfg.Auth.Webhook.URL = *authWebhook
+		case "auth-webhook-token":
+			cfg.Auth.Webhook.Token = *authWebhookToken
+		case "auth-webhook-cache-ttl":
+			cfg.Auth.Webhook.CacheTTL = (*util.Duration)(authWebhookCacheTTL)
+		case "v2board-api-host":
+			cfg.Auth.V2board.APIHost = *v2boardApiHost
+		case "v2board-api-key":
+			cfg.Auth.V2board.APIKey = *v2boardApiKey
+		case "v2board-node-id":
+			cfg.Auth.V2board.NodeID = *v2boardNodeID
+		case "v2board-pull-interval":
+			cfg.Auth.V2board.PullInterval = util.Duration(*v2boardPullInterval)
+		case "v2board-push-interval":
+			cfg.Auth.V2board.PushInterval = util.Duration(*v2boardPushInterval)
+		}
+	})
+	if *sniRoutes != "" {
+		routes, err := loadSNIRoutesConfig(*sniRoutes)
 		if err != nil {
-			logrus.Fatalln("打开 padding-scheme 文件失败:", err)
+			logrus.Fatalln("加载 SNI 路由表失败:", err)
 		}
-		b, err := io.ReadAll(f)
-		f.Close()
+		cfg.TLS.SNI = routes
+	}
+	if err := cfg.validate(); err != nil {
+		logrus.Fatalln("配置错误:", err)
+	}
+
+	// ---- 填充方案（可选） ----
+	if cfg.Padding.Scheme != "" {
+		b, err := os.ReadFile(cfg.Padding.Scheme)
 		if err != nil {
 			logrus.Fatalln("读取 padding-scheme 文件失败:", err)
 		}
 		if padding.UpdatePaddingScheme(b) {
-			logrus.Infoln("已加载自定义填充方案:", *paddingScheme)
+			logrus.Infoln("已加载自定义填充方案:", cfg.Padding.Scheme)
+		} else {
+			logrus.Errorln("填充方案格式错误:", cfg.Padding.Scheme)
+		}
+	}
+	if cfg.Padding.Downstream != "" {
+		b, err := os.ReadFile(cfg.Padding.Downstream)
+		if err != nil {
+			logrus.Fatalln("读取 downstream-padding-scheme 文件失败:", err)
+		}
+		if padding.UpdateDownstreamPaddingScheme(b) {
+			logrus.Infoln("已加载自定义下行填充方案:", cfg.Padding.Downstream)
 		} else {
-			logrus.Errorln("填充方案格式错误:", *paddingScheme)
+			logrus.Errorln("下行填充方案格式错误:", cfg.Padding.Downstream)
 		}
 	}
 
+	// ---- 出站参数 ----
+	if cfg.Outbound.DialTimeout > 0 {
+		proxy.SystemDialer.Timeout = time.Duration(cfg.Outbound.DialTimeout)
+	}
+
 	// ---- 使用 V2board 模式 ----
-	isV2boardMode := *v2boardApiHost != "" && *v2boardApiKey != "" && *v2boardNodeID != 0
+	v2b := &cfg.Auth.V2board
+	isV2boardMode := v2b.enabled()
 
-	// 判断参数完整性
-	if isV2boardMode {
+	switch {
+	case isV2boardMode:
 		logrus.Infof("[Server] %s (V2board 模式)", util.ProgramVersionName)
-		if *v2boardNodeID == 0 {
-			logrus.Fatalln("V2board 模式下必须指定 --v2board-node-id")
-		}
-	} else {
-		// 普通密码模式必须提供密码
-		if *password == "" {
-			logrus.Fatalln("请通过 -p 指定密码，或使用 --v2board-* 参数启用 V2board 模式")
-		}
+	case cfg.Auth.UsersFile != "":
+		logrus.Infof("[Server] %s (用户文件模式)", util.ProgramVersionName)
+	case cfg.Auth.Webhook.URL != "":
+		logrus.Infof("[Server] %s (Webhook 模式)", util.ProgramVersionName)
+	default:
 		logrus.Infof("[Server] %s (普通密码模式)", util.ProgramVersionName)
 	}
 
-	// ---- 从 V2board 拉取节点配置（覆盖监听端口等） ----
+	// ---- 从 V2board 拉取节点配置（未手动指定时覆盖监听端口与同步周期） ----
 	if isV2boardMode {
-		apiClient := v2board.NewClient(*v2boardApiHost, *v2boardApiKey, *v2boardNodeID)
+		apiClient := v2board.NewClient(v2b.APIHost, v2b.APIKey, v2b.NodeID)
 		nodeInfo, err := apiClient.GetNodeInfo()
 		if err != nil {
 			logrus.Warnf("[V2board] 拉取节点配置失败（使用默认参数继续）: %v", err)
 		} else {
 			logrus.Infof("[V2board] 节点配置已拉取，节点端口: %d", nodeInfo.ServerPort)
-			if nodeInfo.ServerPort > 0 {
-				*listen = ":" + formatUint(nodeInfo.ServerPort)
+			if len(cfg.Listeners) == 0 && nodeInfo.ServerPort > 0 {
+				cfg.Listeners = []string{":" + formatUint(nodeInfo.ServerPort)}
 			}
-			// 若面板配置了同步周期，则使用面板值（命令行参数优先）
-			if *v2boardPullInterval == 60*time.Second && nodeInfo.BaseConfig.PullInterval > 0 {
-				*v2boardPullInterval = time.Duration(nodeInfo.BaseConfig.PullInterval) * time.Second
+			// 若面板配置了同步周期，则使用面板值（命令行参数与配置文件优先）
+			if v2b.PullInterval == 0 && nodeInfo.BaseConfig.PullInterval > 0 {
+				v2b.PullInterval = util.Duration(time.Duration(nodeInfo.BaseConfig.PullInterval) * time.Second)
 			}
-			if *v2boardPushInterval == 60*time.Second && nodeInfo.BaseConfig.PushInterval > 0 {
-				*v2boardPushInterval = time.Duration(nodeInfo.BaseConfig.PushInterval) * time.Second
+			if v2b.PushInterval == 0 && nodeInfo.BaseConfig.PushInterval > 0 {
+				v2b.PushInterval = util.Duration(time.Duration(nodeInfo.BaseConfig.PushInterval) * time.Second)
 			}
 		}
+		if v2b.PullInterval == 0 {
+			v2b.PullInterval = util.Duration(*v2boardPullInterval)
+		}
+		if v2b.PushInterval == 0 {
+			v2b.PushInterval = util.Duration(*v2boardPushInterval)
+		}
+	}
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []string{*listen}
+	}
+	// 以下配置项为 0 时有意义（关闭对应功能），只有未配置时才使用参数默认值
+	if cfg.DrainTimeout == nil {
+		cfg.DrainTimeout = (*util.Duration)(drainTimeout)
+	}
+	if cfg.Heartbeat.Interval == nil {
+		cfg.Heartbeat.Interval = (*util.Duration)(heartbeatInterval)
+	}
+	if cfg.Heartbeat.Timeout == nil {
+		cfg.Heartbeat.Timeout = (*util.Duration)(heartbeatTimeout)
+	}
+	if cfg.Auth.Webhook.CacheTTL == nil {
+		cfg.Auth.Webhook.CacheTTL = (*util.Duration)(authWebhookCacheTTL)
+	}
+	if ss := &cfg.TLS.SelfSigned; ss.Dir != "" {
+		if ss.KeyType == "" {
+			ss.KeyType = *certKeyType
+		}
+		if ss.Validity == 0 {
+			ss.Validity = util.Duration(*certValidity)
+		}
+		if ss.RenewBefore == 0 {
+			ss.RenewBefore = ss.Validity / 3
+		}
+		if ss.RenewBefore >= ss.Validity {
+			logrus.Fatalln("配置错误: tls.self_signed.renew_before: 必须小于有效期")
+		}
 	}
 
-	logrus.Infoln("[Server] 监听 TCP", *listen)
+	// ---- 只输出分享链接 ----
+	if *printURI {
+		if err := printShareURIs(os.Stdout, cfg, *uriHost); err != nil {
+			logrus.Fatalln("生成分享链接失败:", err)
+		}
+		return
+	}
 
 	// ---- 创建 TCP 监听 ----
-	listener, err := net.Listen("tcp", *listen)
-	if err != nil {
-		logrus.Fatalln("监听 TCP 失败:", err)
+	listeners := make([]net.Listener, 0, len(cfg.Listeners))
+	for _, addr := range cfg.Listeners {
+		logrus.Infoln("[Server] 监听 TCP", addr)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			logrus.Fatalln("监听 TCP 失败:", err)
+		}
+		listeners = append(listeners, listener)
 	}
 
-	// ---- 生成自签名 TLS 证书 ----
-	tlsCert, _ := util.GenerateKeyPair(time.Now, "")
-	tlsConfig := &tls.Config{
-		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx := context.Background()
+
+	// ---- TLS 证书：从文件加载（支持热重载）、使用状态目录中的自签名证书或生成临时自签名证书 ----
+	tlsConfig := &tls.Config{}
+	switch {
+	case cfg.TLS.Cert != "":
+		loader, err := newCertLoader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			logrus.Fatalln("加载 TLS 证书失败:", err)
+		}
+		tlsConfig.GetCertificate = loader.GetCertificate
+		util.StartRoutine(ctx, certCheckInterval, loader.checkModified)
+		go reloadCertOnSignal(loader)
+		logrus.Infoln("[TLS] 已加载证书:", cfg.TLS.Cert)
+	case cfg.TLS.SelfSigned.Dir != "":
+		selfSigned, err := newSelfSignedCert(cfg.TLS.SelfSigned)
+		if err != nil {
+			logrus.Fatalln("加载自签名证书失败:", err)
+		}
+		tlsConfig.GetCertificate = selfSigned.GetCertificate
+		// 有效期很短时按 renew_before 缩短检查周期，避免错过轮换时机
+		checkInterval := min(selfSignedCheckInterval, time.Duration(cfg.TLS.SelfSigned.RenewBefore)/2)
+		util.StartRoutine(ctx, checkInterval, selfSigned.checkRenew)
+	default:
+		tlsCert, _ := util.GenerateKeyPair(time.Now, "")
+		tlsConfig.GetCertificate = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			return tlsCert, nil
-		},
+		}
+	}
+
+	// ---- 出站规则 ----
+	outbound, err := newOutboundRouter(cfg.Outbound)
+	if err != nil {
+		logrus.Fatalln("配置错误:", err)
+	}
+	if len(cfg.Outbound.Rules) > 0 {
+		logrus.Infof("[Server] 已加载 %d 条出站规则", len(cfg.Outbound.Rules))
+	}
+	opts := serverOptions{
+		heartbeat: cfg.Heartbeat,
+		outbound:  outbound,
+	}
+	if cfg.Padding.DownstreamEnabled || cfg.Padding.Downstream != "" {
+		opts.downstreamPadding = &padding.DefaultDownstreamPaddingFactory
+		logrus.Infoln("[Server] 已启用下行填充")
+	}
+
+	// ---- 认证失败 fallback（可选） ----
+	if cfg.Fallback != "" {
+		fb, err := newFallback(cfg.Fallback)
+		if err != nil {
+			logrus.Fatalln("配置错误: fallback:", err)
+		}
+		opts.fallbackFunc = fb
+		logrus.Infoln("[Server] fallback:", cfg.Fallback)
 	}
 
-	ctx := context.Background()
 	var server *myServer
 
-	if isV2boardMode {
-		apiClient := v2board.NewClient(*v2boardApiHost, *v2boardApiKey, *v2boardNodeID)
+	switch {
+	case isV2boardMode:
+		apiClient := v2board.NewClient(v2b.APIHost, v2b.APIKey, v2b.NodeID)
 		authMgr := v2board.NewAuthManager(apiClient)
 		trafficMgr := v2board.NewTrafficManager(apiClient)
+		aliveMgr := v2board.NewAliveManager(apiClient, authMgr)
+		pullInterval := time.Duration(v2b.PullInterval)
+		pushInterval := time.Duration(v2b.PushInterval)
+
+		server, err = NewMyServerV2board(tlsConfig, authMgr, trafficMgr, aliveMgr, opts)
+		if err != nil {
+			logrus.Fatalln("创建 AnyTLS 服务失败:", err)
+		}
 
 		// 启动定时拉取用户列表（阻塞直到首次拉取成功可在 Start 内处理）
-		go authMgr.Start(*v2boardPullInterval)
+		go authMgr.Start(pullInterval)
 		// 启动定时流量上报
-		go trafficMgr.Start(*v2boardPushInterval)
+		go trafficMgr.Start(pushInterval)
+		// 启动定时在线 IP 上报（与流量上报周期相同）
+		go aliveMgr.Start(pushInterval)
+	case cfg.Auth.UsersFile != "":
+		users, err := auth.NewFileAuthenticator(cfg.Auth.UsersFile)
+		if err != nil {
+			logrus.Fatalln("加载用户文件失败:", err)
+		}
+		logrus.Infof("[Server] 已加载用户文件 %s（%d 个用户）", cfg.Auth.UsersFile, users.UserCount())
+		server, err = NewMyServer(tlsConfig, users, opts)
+		if err != nil {
+			logrus.Fatalln("创建 AnyTLS 服务失败:", err)
+		}
+		// 在 NewMyServer 设置踢线回调之后才开始监视文件
+		util.StartRoutine(ctx, usersFileCheckInterval, users.CheckModified)
+	case cfg.Auth.Webhook.URL != "":
+		webhook := &cfg.Auth.Webhook
+		server, err = NewMyServer(tlsConfig, auth.NewWebhookAuthenticator(webhook.URL, webhook.Token, time.Duration(*webhook.CacheTTL)), opts)
+	default:
+		server, err = NewMyServer(tlsConfig, auth.NewPasswords(cfg.Auth.Password), opts)
+	}
+	if err != nil {
+		logrus.Fatalln("创建 AnyTLS 服务失败:", err)
+	}
+
+	// ---- 监控指标（可选） ----
+	if cfg.Metrics != "" {
+		registerServerGauges(server.sessions)
+		go func() {
+			logrus.Infoln("[Server] 监控指标 http://" + cfg.Metrics + "/metrics")
+			if err := metrics.ListenAndServe(cfg.Metrics); err != nil {
+				logrus.Errorln("监控指标服务退出:", err)
+			}
+		}()
+	}
+
+	// ---- SNI 路由（可选） ----
+	var router *sniRouter
+	if cfg.TLS.SNI != nil {
+		router, err = newSNIRouter(ctx, *cfg.TLS.SNI, server)
+		if err != nil {
+			logrus.Fatalln("配置错误: tls.sni.", err)
+		}
+		logrus.Infof("[Server] 已加载 SNI 路由表（%d 条路由）", len(router.routes))
+	}
+
+	// ---- 本地管理接口（可选） ----
+	if cfg.Admin != "" {
+		adminListener, err := listenAdmin(cfg.Admin)
+		if err != nil {
+			logrus.Fatalln("监听管理接口失败:", err)
+		}
+		admin := &adminServer{server: server, router: router, paddingSchemePath: cfg.Padding.Scheme, downstreamPaddingSchemePath: cfg.Padding.Downstream}
+		go func() {
+			logrus.Infoln("[Server] 管理接口:", cfg.Admin)
+			if err := admin.serve(adminListener); err != nil {
+				logrus.Errorln("管理接口退出:", err)
+			}
+		}()
+	}
 
-		server = NewMyServerV2board(tlsConfig, authMgr, trafficMgr)
-	} else {
-		sum := sha256.Sum256([]byte(*password))
-		server = NewMyServer(tlsConfig, sum[:])
+	// ---- 主循环：接受连接，直到收到退出信号 ----
+	for _, listener := range listeners {
+		go acceptLoop(ctx, listener, server, router)
 	}
+	waitForShutdown(listeners, server, time.Duration(*cfg.DrainTimeout))
+}
 
-	// ---- 主循环：接受连接 ----
+// acceptLoop 在一个监听上接受连接，配置了 SNI 路由时先按 SNI 分发
+func acceptLoop(ctx context.Context, listener net.Listener, server *myServer, router *sniRouter) {
 	for {
 		c, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logrus.Fatalln("accept:", err)
 		}
-		go handleTcpConnection(ctx, c, server)
+		if router != nil {
+			go router.handleConnection(ctx, c)
+		} else {
+			go server.serveConn(ctx, c)
+		}
+	}
+}
+
+// reloadCertOnSignal 收到 SIGHUP 时立即重载证书
+func reloadCertOnSignal(loader *certLoader) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := loader.reload(); err != nil {
+			logrus.Errorln("[TLS] SIGHUP 重载证书失败（继续使用旧证书）:", err)
+			continue
+		}
+		logrus.Infoln("[TLS] 收到 SIGHUP，证书已重新加载")
 	}
 }
 
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"anytls/metrics"
+	"strconv"
+)
+
+var (
+	metricAuthFailures = metrics.NewCounter("anytls_server_auth_failures_total", "Connections that failed authentication.")
+	metricFallbacks    = metrics.NewCounter("anytls_server_fallbacks_total", "Connections handed to the fallback handler.")
+	metricUserTraffic  = metrics.NewCounterVec("anytls_server_user_traffic_bytes_total", "Proxied bytes per user.", "user", "direction")
+)
+
+// registerServerGauges 注册依赖会话注册表的实时指标
+func registerServerGauges(sessions *sessionRegistry) {
+	metrics.NewGaugeFunc("anytls_server_sessions", "Live authenticated sessions.", func() float64 {
+		return float64(sessions.count())
+	})
+	metrics.NewGaugeFunc("anytls_server_streams", "Live streams over all sessions.", func() float64 {
+		return float64(sessions.streamCount())
+	})
+}
+
+// recordTrafficMetric 按用户累计代理字节数
+func recordTrafficMetric(userID int, upload, download int64) {
+	user := strconv.Itoa(userID)
+	if upload > 0 {
+		metricUserTraffic.Add(uint64(upload), user, "upload")
+	}
+	if download > 0 {
+		metricUserTraffic.Add(uint64(download), user, "download")
+	}
+}
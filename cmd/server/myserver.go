@@ -1,67 +1,153 @@
 package main
 
 import (
+	"anytls"
+	"anytls/auth"
+	"anytls/proxy/padding"
+	"anytls/util"
 	"anytls/v2board"
 	"crypto/tls"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
 )
 
-// myServer 代表服务器实例，支持两种鉴权模式：
-//   - 普通密码模式：使用固定的 sha256(password)
+// myServer 代表服务器实例，认证交给 auth.Authenticator：
+//   - 普通密码模式：使用固定的 sha256(password)（可以有多个）
+//   - 用户文件模式：多用户文本文件，修改后自动重载
+//   - Webhook 模式：向 HTTP 接口查询认证结果
 //   - V2board 模式：从面板动态拉取用户列表，使用 sha256(uuid) 认证
 type myServer struct {
 	tlsConfig *tls.Config
 
-	// 普通密码模式（与 V2board 模式互斥）
-	passwordSha256 []byte
+	// padding 是该服务器使用的填充方案
+	padding *atomic.TypedValue[*padding.PaddingFactory]
+	// downstreamPadding 是服务器发往客户端方向的填充方案，nil 表示不填充
+	downstreamPadding *atomic.TypedValue[*padding.PaddingFactory]
+
+	// authenticator 是当前的认证器
+	authenticator auth.Authenticator
 
-	// V2board 模式（与普通密码模式互斥）
+	// V2board 模式下的面板管理器，其它模式下为 nil
 	v2boardAuth    *v2board.AuthManager
 	v2boardTraffic *v2board.TrafficManager
+	v2boardAlive   *v2board.AliveManager
+
+	// outbound 按规则为代理请求选择出站
+	outbound *outboundRouter
+
+	// fallbackFunc 处理认证失败的连接，为 nil 时直接关闭
+	fallbackFunc fallbackFunc
+
+	// sessions 登记所有已认证的会话
+	sessions *sessionRegistry
+
+	// heartbeat 是会话的主动保活参数，Interval 为 0 时不主动发送心跳
+	heartbeat heartbeatConfig
+
+	// server 完成 TLS 握手、认证与会话复用，在 NewMyServer 中按最终配置创建
+	server *anytls.Server
+}
+
+// serverOptions 是创建服务器时除 TLS 与认证之外的配置，SNI 路由沿用默认服务器的这些配置
+type serverOptions struct {
+	heartbeat    heartbeatConfig
+	outbound     *outboundRouter
+	fallbackFunc fallbackFunc
+	// sessions 为 nil 时新建会话登记表
+	sessions *sessionRegistry
+	// padding 为 nil 时使用默认填充方案，downstreamPadding 为 nil 时不填充下行流量
+	padding           *atomic.TypedValue[*padding.PaddingFactory]
+	downstreamPadding *atomic.TypedValue[*padding.PaddingFactory]
 }
 
-// NewMyServer 创建普通密码模式的服务器实例
-func NewMyServer(tlsConfig *tls.Config, passwordSha256 []byte) *myServer {
-	return &myServer{
-		tlsConfig:      tlsConfig,
-		passwordSha256: passwordSha256,
+// NewMyServer 创建使用 authenticator 认证的服务器实例，配置需在调用前全部确定
+func NewMyServer(tlsConfig *tls.Config, authenticator auth.Authenticator, opts serverOptions) (*myServer, error) {
+	s := &myServer{
+		tlsConfig:         tlsConfig,
+		padding:           opts.padding,
+		downstreamPadding: opts.downstreamPadding,
+		authenticator:     authenticator,
+		outbound:          opts.outbound,
+		fallbackFunc:      opts.fallbackFunc,
+		sessions:          opts.sessions,
+		heartbeat:         opts.heartbeat,
+	}
+	if s.padding == nil {
+		s.padding = &padding.DefaultPaddingFactory
+	}
+	if s.sessions == nil {
+		s.sessions = newSessionRegistry()
 	}
+	server, err := anytls.NewServer(nil, anytls.ServerConfig{
+		TLSConfig:         s.tlsConfig,
+		Authenticator:     s,
+		Padding:           s.padding,
+		DownstreamPadding: s.downstreamPadding,
+		HeartbeatInterval: time.Duration(*s.heartbeat.Interval),
+		HeartbeatTimeout:  time.Duration(*s.heartbeat.Timeout),
+		Fallback:          s.fallback,
+		OnSession:         s.onSession,
+		OnSessionClosed:   s.onSessionClosed,
+		Handler:           s.handleStream,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.server = server
+	// 用户失效（移出用户表、改密码、超出配额等）后立即踢下线，而不是等到下次重连
+	if revoker, ok := authenticator.(auth.Revoker); ok {
+		revoker.OnUsersRemoved(func(userIDs []int) {
+			s.sessions.kickUsers(userIDs, "user is no longer valid")
+		})
+	}
+	return s, nil
 }
 
 // NewMyServerV2board 创建 V2board 模式的服务器实例
-func NewMyServerV2board(tlsConfig *tls.Config, authMgr *v2board.AuthManager, trafficMgr *v2board.TrafficManager) *myServer {
-	return &myServer{
-		tlsConfig:      tlsConfig,
-		v2boardAuth:    authMgr,
-		v2boardTraffic: trafficMgr,
+func NewMyServerV2board(tlsConfig *tls.Config, authMgr *v2board.AuthManager, trafficMgr *v2board.TrafficManager, aliveMgr *v2board.AliveManager, opts serverOptions) (*myServer, error) {
+	s, err := NewMyServer(tlsConfig, authMgr, opts)
+	if err != nil {
+		return nil, err
 	}
+	s.v2boardAuth = authMgr
+	s.v2boardTraffic = trafficMgr
+	s.v2boardAlive = aliveMgr
+	return s, nil
 }
 
-// authenticate 验证客户端发来的 32 字节密码哈希。
-// 返回该用户的 ID（V2board 模式下为真实用户 ID；普通模式下固定返回 0）和认证结果。
-func (s *myServer) authenticate(passwordHash []byte) (userID int, ok bool) {
-	if s.v2boardAuth != nil {
-		// V2board 模式：在用户表中查找 sha256(uuid)
-		return s.v2boardAuth.CheckAuth(passwordHash)
-	}
-	// 普通密码模式：对比固定哈希
-	if len(passwordHash) == len(s.passwordSha256) {
-		match := true
-		for i := range passwordHash {
-			if passwordHash[i] != s.passwordSha256[i] {
-				match = false
-				break
-			}
-		}
-		if match {
-			return 0, true
-		}
+// userCount 返回认证器中的用户数，无法统计（如 Webhook 模式）时返回 -1
+func (s *myServer) userCount() int {
+	if counter, ok := s.authenticator.(interface{ UserCount() int }); ok {
+		return counter.UserCount()
 	}
-	return 0, false
+	return -1
 }
 
-// recordTraffic 在连接结束后记录该用户的流量（仅 V2board 模式有效）
+// recordTraffic 在连接结束后记录该用户的流量（面板上报仅 V2board 模式有效，配额统计仅用户文件模式有效）
 func (s *myServer) recordTraffic(userID int, upload, download int64) {
+	recordTrafficMetric(userID, upload, download)
 	if s.v2boardTraffic != nil && userID > 0 {
 		s.v2boardTraffic.Record(userID, upload, download)
 	}
+	if recorder, ok := s.authenticator.(auth.TrafficRecorder); ok {
+		recorder.RecordTraffic(userID, upload, download)
+	}
+}
+
+// speedLimiter 返回该用户的限速器（仅 V2board 模式有效），nil 表示不限速
+func (s *myServer) speedLimiter(userID int) *util.SpeedLimiter {
+	if s.v2boardAuth != nil && userID > 0 {
+		return s.v2boardAuth.SpeedLimiter(userID)
+	}
+	return nil
+}
+
+// acquireOnline 登记用户从 ip 建立的会话（仅 V2board 模式有效）。
+// 超过面板设置的设备数限制时返回 ok=false；否则会话结束时必须调用 release。
+func (s *myServer) acquireOnline(userID int, ip string) (release func(), ok bool) {
+	if s.v2boardAlive != nil && userID > 0 {
+		return s.v2boardAlive.Acquire(userID, ip)
+	}
+	return func() {}, true
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"anytls/proxy"
+	"anytls/route"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/http"
+	"github.com/sagernet/sing/protocol/socks"
+	"github.com/sirupsen/logrus"
+)
+
+// 内置出站名称
+const (
+	outboundDirect = "direct"
+	outboundReject = "reject"
+)
+
+// outboundRouter 按规则为每个代理请求选择出站，规则按顺序匹配，第一条匹配的规则生效
+type outboundRouter struct {
+	rules []*outboundRule
+	// final 是没有规则匹配时使用的出站
+	final *outbound
+}
+
+// outbound 是一个具名出站，dialer 为 nil 表示拒绝
+type outbound struct {
+	name   string
+	dialer N.Dialer
+	// direct 为 true 时，规则匹配中已解析出的 IP 会直接用于连接，避免再次解析得到不同的地址
+	direct bool
+}
+
+// outboundRule 是一条出站规则：domain_* 与 ip_cidr 之间任意一项匹配即可，
+// 再与 port、user、network 同时满足时规则匹配
+type outboundRule struct {
+	route.Matcher
+	users    map[int]bool
+	network  string
+	outbound *outbound
+}
+
+// outboundRequest 是一次路由的输入，域名目标在遇到 ip_cidr 规则时才解析，且只解析一次
+type outboundRequest struct {
+	network     string
+	userID      int
+	destination M.Socksaddr
+
+	resolved   bool
+	addresses  []netip.Addr
+	resolveErr error
+}
+
+// newOutboundRouter 根据配置创建路由，错误信息中包含出错的配置项
+func newOutboundRouter(c serverOutboundConf) (*outboundRouter, error) {
+	outbounds := map[string]*outbound{
+		outboundDirect: {name: outboundDirect, dialer: &directDialer{dialer: proxy.SystemDialer}, direct: true},
+		outboundReject: {name: outboundReject},
+	}
+	for i, oc := range c.Outbounds {
+		o, err := newOutbound(oc)
+		if err != nil {
+			return nil, fmt.Errorf("outbound.outbounds[%d]: %w", i, err)
+		}
+		if _, exists := outbounds[o.name]; exists {
+			return nil, fmt.Errorf("outbound.outbounds[%d]: 出站名称 %s 重复", i, o.name)
+		}
+		outbounds[o.name] = o
+	}
+
+	r := &outboundRouter{final: outbounds[outboundDirect]}
+	if c.Final != "" {
+		final, exists := outbounds[c.Final]
+		if !exists {
+			return nil, fmt.Errorf("outbound.final: 未定义的出站 %s", c.Final)
+		}
+		r.final = final
+	}
+	for i, rc := range c.Rules {
+		rule, err := newOutboundRule(rc, outbounds)
+		if err != nil {
+			return nil, fmt.Errorf("outbound.rules[%d].%w", i, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func newOutbound(c outboundConfig) (*outbound, error) {
+	if c.Name == "" {
+		return nil, errors.New("name 不能为空")
+	}
+	direct := &directDialer{dialer: proxy.SystemDialer}
+	if c.Bind != "" {
+		bind, err := netip.ParseAddr(c.Bind)
+		if err != nil {
+			return nil, fmt.Errorf("bind: %w", err)
+		}
+		direct = &directDialer{
+			dialer: &net.Dialer{Timeout: proxy.SystemDialer.Timeout, LocalAddr: &net.TCPAddr{IP: bind.AsSlice()}},
+			bind:   bind,
+		}
+	}
+
+	o := &outbound{name: c.Name}
+	switch c.Type {
+	case "", outboundDirect:
+		o.dialer, o.direct = direct, true
+	case "socks5", "http":
+		server := M.ParseSocksaddr(c.Server)
+		if !server.IsValid() || server.Port == 0 {
+			return nil, fmt.Errorf("server: 无效的地址 %q", c.Server)
+		}
+		if c.Type == "socks5" {
+			o.dialer = socks.NewClient(direct, server, socks.Version5, c.Username, c.Password)
+		} else {
+			o.dialer = http.NewClient(http.Options{Dialer: direct, Server: server, Username: c.Username, Password: c.Password})
+		}
+	default:
+		return nil, fmt.Errorf("type: 不支持的出站类型 %s（可选 direct、socks5、http）", c.Type)
+	}
+	return o, nil
+}
+
+func newOutboundRule(c outboundRuleConfig, outbounds map[string]*outbound) (*outboundRule, error) {
+	rule := &outboundRule{network: c.Network}
+	switch c.Network {
+	case "", "tcp", "udp":
+	default:
+		return nil, errors.New("network: 只能是 tcp 或 udp")
+	}
+	for _, suffix := range c.DomainSuffix {
+		rule.AddDomainSuffix(suffix)
+	}
+	for _, keyword := range c.DomainKeyword {
+		rule.AddDomainKeyword(keyword)
+	}
+	for i, expr := range c.DomainRegex {
+		if err := rule.AddDomainRegex(expr); err != nil {
+			return nil, fmt.Errorf("domain_regex[%d]: %w", i, err)
+		}
+	}
+	// 允许不带前缀长度的单个地址
+	for i, cidr := range c.IPCIDR {
+		prefix, err := route.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("ip_cidr[%d]: %w", i, err)
+		}
+		rule.AddPrefix(prefix)
+	}
+	for i, port := range c.Port {
+		pr, err := route.ParsePortRange(port)
+		if err != nil {
+			return nil, fmt.Errorf("port[%d]: %w", i, err)
+		}
+		rule.AddPortRange(pr)
+	}
+	if len(c.User) > 0 {
+		rule.users = make(map[int]bool, len(c.User))
+		for _, userID := range c.User {
+			rule.users[userID] = true
+		}
+	}
+
+	if c.Outbound == "" {
+		return nil, errors.New("outbound: 不能为空")
+	}
+	o, exists := outbounds[c.Outbound]
+	if !exists {
+		return nil, fmt.Errorf("outbound: 未定义的出站 %s", c.Outbound)
+	}
+	rule.outbound = o
+	return rule, nil
+}
+
+// dialTCP 按规则选择出站并连接 destination，被拒绝时返回的错误会通过 cmdSYNACK 告知客户端
+func (r *outboundRouter) dialTCP(ctx context.Context, userID int, destination M.Socksaddr) (net.Conn, error) {
+	req := &outboundRequest{network: N.NetworkTCP, userID: userID, destination: destination}
+	o, err := r.route(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if o.direct && len(req.addresses) > 0 {
+		return N.DialSerial(ctx, o.dialer, N.NetworkTCP, destination, req.addresses)
+	}
+	return o.dialer.DialContext(ctx, N.NetworkTCP, destination)
+}
+
+// listenUDP 按规则选择出站并为发往 destination 的 UDP 创建 PacketConn。
+// 返回实际发送的目标地址：直连时使用规则匹配中已解析出的 IP。
+func (r *outboundRouter) listenUDP(ctx context.Context, userID int, destination M.Socksaddr) (net.PacketConn, M.Socksaddr, error) {
+	req := &outboundRequest{network: N.NetworkUDP, userID: userID, destination: destination}
+	o, err := r.route(ctx, req)
+	if err != nil {
+		return nil, destination, err
+	}
+	if o.direct && len(req.addresses) > 0 {
+		destination = M.SocksaddrFrom(req.addresses[0], destination.Port)
+	}
+	c, err := o.dialer.ListenPacket(ctx, destination)
+	return c, destination, err
+}
+
+// route 返回第一条匹配规则的出站，出站为 reject 时返回错误。
+// 遇到 ip_cidr 规则而域名无法解析时同样拒绝：无法判断该规则是否匹配，
+// 不能因此落到后面的规则或 final 上，否则解析失败就能绕过 ip_cidr 的 reject 规则。
+func (r *outboundRouter) route(ctx context.Context, req *outboundRequest) (*outbound, error) {
+	o := r.final
+	for _, rule := range r.rules {
+		matched, err := rule.match(ctx, req)
+		if err != nil {
+			logrus.Debugln("[Outbound] 解析域名失败，拒绝:", req.network, req.destination, "user", req.userID, err)
+			return nil, fmt.Errorf("rejected by server outbound rules: resolve %s: %w", req.destination.Fqdn, err)
+		}
+		if matched {
+			o = rule.outbound
+			break
+		}
+	}
+	if o.dialer == nil {
+		logrus.Debugln("[Outbound] 规则拒绝:", req.network, req.destination, "user", req.userID)
+		return nil, errors.New("rejected by server outbound rules")
+	}
+	return o, nil
+}
+
+// match 判断规则是否匹配，只有需要检查 ip_cidr 且域名解析失败时返回错误
+func (rule *outboundRule) match(ctx context.Context, req *outboundRequest) (bool, error) {
+	if rule.network != "" && rule.network != req.network {
+		return false, nil
+	}
+	if rule.users != nil && !rule.users[req.userID] {
+		return false, nil
+	}
+	if !rule.MatchPort(req.destination.Port) {
+		return false, nil
+	}
+	if !rule.HasDestination() {
+		return true, nil
+	}
+	if req.destination.IsFqdn() && rule.MatchDomain(route.NormalizeDomain(req.destination.Fqdn)) {
+		return true, nil
+	}
+	if !rule.HasIP() {
+		return false, nil
+	}
+	addresses, err := req.resolve(ctx)
+	if err != nil {
+		return false, err
+	}
+	return rule.MatchIP(addresses), nil
+}
+
+// resolve 返回目标的 IP 地址，域名在首次调用时解析，结果（包括失败）只解析一次
+func (req *outboundRequest) resolve(ctx context.Context) ([]netip.Addr, error) {
+	if !req.destination.IsFqdn() {
+		return []netip.Addr{req.destination.Addr.Unmap()}, nil
+	}
+	if !req.resolved {
+		req.resolved = true
+		addresses, err := net.DefaultResolver.LookupNetIP(ctx, "ip", req.destination.Fqdn)
+		if err == nil && len(addresses) == 0 {
+			err = errors.New("no addresses")
+		}
+		req.resolveErr = err
+		for _, addr := range addresses {
+			req.addresses = append(req.addresses, addr.Unmap())
+		}
+	}
+	return req.addresses, req.resolveErr
+}
+
+// directDialer 直接连接目标，bind 有效时从该本地地址发起连接
+type directDialer struct {
+	dialer *net.Dialer
+	bind   netip.Addr
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, N.NetworkName(network), destination.String())
+}
+
+func (d *directDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	laddr := &net.UDPAddr{}
+	if d.bind.IsValid() {
+		laddr.IP = d.bind.AsSlice()
+	}
+	return net.ListenUDP(N.NetworkUDP, laddr)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestOutboundRoute(t *testing.T) {
+	r, err := newOutboundRouter(serverOutboundConf{
+		Outbounds: []outboundConfig{{Name: "proxy", Type: "socks5", Server: "127.0.0.1:1080"}},
+		Rules: []outboundRuleConfig{
+			{Port: []string{"25", "465-587"}, Outbound: outboundReject},
+			{DomainSuffix: []string{"Blocked.example"}, Outbound: outboundReject},
+			{User: []int{7}, DomainKeyword: []string{"video"}, Outbound: "proxy"},
+			{Network: "udp", Port: []string{"53"}, Outbound: "proxy"},
+			{DomainRegex: []string{`^api\d+\.`}, Outbound: "proxy"},
+			// 只对 80 端口检查，其它用例的域名无需解析
+			{IPCIDR: []string{"127.0.0.0/8", "::1", "10.0.0.0/8"}, Port: []string{"80"}, Outbound: outboundReject},
+		},
+		Final: outboundDirect,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		network     string
+		userID      int
+		destination string
+		want        string
+	}{
+		{"port", N.NetworkTCP, 1, "example.com:25", outboundReject},
+		{"port range", N.NetworkTCP, 1, "1.1.1.1:500", outboundReject},
+		{"domain suffix", N.NetworkTCP, 1, "www.blocked.example:443", outboundReject},
+		{"domain suffix with trailing dot", N.NetworkTCP, 1, "BLOCKED.example.:443", outboundReject},
+		{"keyword for the user", N.NetworkTCP, 7, "video.example:443", "proxy"},
+		{"keyword for another user", N.NetworkTCP, 1, "video.example:443", outboundDirect},
+		{"network", N.NetworkUDP, 1, "1.1.1.1:53", "proxy"},
+		{"wrong network", N.NetworkTCP, 1, "1.1.1.1:53", outboundDirect},
+		{"regex", N.NetworkTCP, 1, "api2.example:443", "proxy"},
+		{"ip", N.NetworkTCP, 1, "10.1.2.3:80", outboundReject},
+		{"single address", N.NetworkTCP, 1, "[::1]:80", outboundReject},
+		{"resolved domain", N.NetworkTCP, 1, "localhost:80", outboundReject},
+		{"address out of range", N.NetworkTCP, 1, "1.1.1.1:80", outboundDirect},
+		{"final", N.NetworkTCP, 1, "example.com:443", outboundDirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &outboundRequest{network: tt.network, userID: tt.userID, destination: M.ParseSocksaddr(tt.destination)}
+			o, err := r.route(context.Background(), req)
+			got := outboundReject
+			if err == nil {
+				got = o.name
+			}
+			if got != tt.want {
+				t.Errorf("route(%s %s) = %s, want %s", tt.network, tt.destination, got, tt.want)
+			}
+		})
+	}
+}
+
+// 域名无法解析时不能绕过 ip_cidr 的 reject 规则落到 final
+func TestOutboundRouteResolveFailure(t *testing.T) {
+	r, err := newOutboundRouter(serverOutboundConf{
+		Rules: []outboundRuleConfig{
+			{DomainSuffix: []string{"allowed.invalid"}, Outbound: outboundDirect},
+			{IPCIDR: []string{"10.0.0.0/8"}, Outbound: outboundReject},
+		},
+		Final: outboundDirect,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := &outboundRequest{network: N.NetworkTCP, destination: M.ParseSocksaddr("internal.invalid:80")}
+	if o, err := r.route(ctx, req); err == nil {
+		t.Fatalf("unresolvable domain routed to %s", o.name)
+	}
+	// 在 ip_cidr 规则之前匹配的域名不需要解析
+	req = &outboundRequest{network: N.NetworkTCP, destination: M.ParseSocksaddr("www.allowed.invalid:80")}
+	if o, err := r.route(ctx, req); err != nil || o.name != outboundDirect {
+		t.Fatalf("route() = %v, %v, want direct", o, err)
+	}
+}
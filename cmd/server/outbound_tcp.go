@@ -1,7 +1,7 @@
 package main
 
 import (
-	"anytls/proxy"
+	"anytls/util"
 	"context"
 	"io"
 	"net"
@@ -13,10 +13,10 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// proxyOutboundTCP 建立到目标地址的 TCP 连接并进行双向数据中继。
+// proxyOutboundTCP 按出站规则建立到目标地址的 TCP 连接并进行双向数据中继。
 // 返回 (upload, download) 字节数，分别对应客户端上行和下行流量。
-func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksaddr) (upload, download int64) {
-	c, err := proxy.SystemDialer.DialContext(ctx, "tcp", destination.String())
+func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksaddr, router *outboundRouter, userID int, limiter *util.SpeedLimiter) (upload, download int64) {
+	c, err := router.dialTCP(ctx, userID, destination)
 	if err != nil {
 		logrus.Debugln("proxyOutboundTCP DialContext:", err)
 		_ = E.Errors(err, N.ReportHandshakeFailure(conn, err))
@@ -29,20 +29,20 @@ func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksadd
 	}
 
 	// 双向中继并统计流量
-	upload, download = copyBidirectional(ctx, conn, c)
+	upload, download = copyBidirectional(ctx, conn, c, limiter)
 	return
 }
 
-// proxyOutboundUoT 处理 UDP-over-TCP 代理请求（sing-box UoT v2 协议）。
+// proxyOutboundUoT 处理 UDP-over-TCP 代理请求（sing-box UoT v2 协议），出站规则按请求中的目标地址匹配。
 // 返回 (upload, download) 字节数，分别对应客户端上行和下行流量。
-func proxyOutboundUoT(ctx context.Context, conn net.Conn, destination M.Socksaddr) (upload, download int64) {
+func proxyOutboundUoT(ctx context.Context, conn net.Conn, destination M.Socksaddr, router *outboundRouter, userID int, limiter *util.SpeedLimiter) (upload, download int64) {
 	request, err := uot.ReadRequest(conn)
 	if err != nil {
 		logrus.Debugln("proxyOutboundUoT ReadRequest:", err)
 		return 0, 0
 	}
 
-	c, err := net.ListenPacket("udp", "")
+	c, target, err := router.listenUDP(ctx, userID, request.Destination)
 	if err != nil {
 		logrus.Debugln("proxyOutboundUoT ListenPacket:", err)
 		_ = E.Errors(err, N.ReportHandshakeFailure(conn, err))
@@ -57,17 +57,24 @@ func proxyOutboundUoT(ctx context.Context, conn net.Conn, destination M.Socksadd
 	// UoT 流量通过 uot.NewConn 封装后当普通流走中继；
 	// 暂时不统计 UoT 的精确字节数，以 0 上报（不影响面板近似）
 	uotConn := uot.NewConn(conn, *request)
-	upload, download = copyBidirectional(ctx, uotConn, &udpPacketConnWrapper{PacketConn: c, target: request.Destination})
+	upload, download = copyBidirectional(ctx, uotConn, &udpPacketConnWrapper{PacketConn: c, target: target}, limiter)
 	return
 }
 
 // copyBidirectional 在 src 与 dst 之间执行双向数据复制，并统计流量字节数。
+// limiter 不为 nil 时按用户限速器限制两个方向的速率。
 // 返回 (srcToDst bytes, dstToSrc bytes)，即 (上行 upload, 下行 download)。
-func copyBidirectional(ctx context.Context, client, remote net.Conn) (upload, download int64) {
+func copyBidirectional(ctx context.Context, client, remote net.Conn, limiter *util.SpeedLimiter) (upload, download int64) {
 	done := make(chan struct{}, 2)
 
+	var clientReader, remoteReader io.Reader = client, remote
+	if limiter != nil {
+		clientReader = &limitedReader{ctx: ctx, Reader: client, limiter: limiter.Upload}
+		remoteReader = &limitedReader{ctx: ctx, Reader: remote, limiter: limiter.Download}
+	}
+
 	go func() {
-		n, _ := io.Copy(remote, client)
+		n, _ := io.Copy(remote, clientReader)
 		upload = n
 		// 关闭写方向，通知对端 EOF
 		if tc, ok := remote.(*net.TCPConn); ok {
@@ -79,7 +86,7 @@ func copyBidirectional(ctx context.Context, client, remote net.Conn) (upload, do
 	}()
 
 	go func() {
-		n, _ := io.Copy(client, remote)
+		n, _ := io.Copy(client, remoteReader)
 		download = n
 		if tc, ok := client.(*net.TCPConn); ok {
 			_ = tc.CloseWrite()
@@ -95,6 +102,23 @@ func copyBidirectional(ctx context.Context, client, remote net.Conn) (upload, do
 	return
 }
 
+// limitedReader 在每次读取后向限速器申请令牌，令牌不足时阻塞
+type limitedReader struct {
+	io.Reader
+	ctx     context.Context
+	limiter *util.RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
 // udpPacketConnWrapper 将 net.PacketConn 包装为 net.Conn 接口，供 UoT 使用
 type udpPacketConnWrapper struct {
 	net.PacketConn
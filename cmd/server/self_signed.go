@@ -0,0 +1,272 @@
+package main
+
+import (
+	"anytls/util"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// selfSignedCheckInterval 是检查自签名证书是否需要轮换的周期
+	selfSignedCheckInterval = time.Hour
+
+	selfSignedCertFile = "cert.pem"
+	selfSignedKeyFile  = "key.pem"
+)
+
+// selfSignedCert 管理保存在状态目录中的自签名证书。
+// 私钥只生成一次，证书到期前用同一私钥重新签发，因此公钥指纹（SPKI）在轮换后保持不变。
+type selfSignedCert struct {
+	dir         string
+	keyType     string
+	names       []string
+	validity    time.Duration
+	renewBefore time.Duration
+
+	key  crypto.Signer
+	cert atomic.Pointer[tls.Certificate]
+	// mu 串行化证书的签发
+	mu sync.Mutex
+}
+
+// newSelfSignedCert 从状态目录加载证书，目录中没有可用的私钥或证书时生成并保存
+func newSelfSignedCert(c selfSignedConfig) (*selfSignedCert, error) {
+	s := &selfSignedCert{
+		dir:         c.Dir,
+		keyType:     c.KeyType,
+		names:       sortCertNames(c.Names),
+		validity:    time.Duration(c.Validity),
+		renewBefore: time.Duration(c.RenewBefore),
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := s.loadKey(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reason, err := s.loadCert()
+	if err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		if err := s.issue(reason); err != nil {
+			return nil, err
+		}
+	} else {
+		s.logFingerprints("已加载自签名证书")
+	}
+	return s, nil
+}
+
+// loadKey 读取私钥，不存在时生成新私钥；类型与配置不同时返回错误，不会覆盖已有私钥
+func (s *selfSignedCert) loadKey() error {
+	keyPath := filepath.Join(s.dir, selfSignedKeyFile)
+	signer, err := readSelfSignedKey(keyPath, s.keyType)
+	if err == nil {
+		s.key = signer
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := util.GenerateKey(s.keyType)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	s.key = key
+	return nil
+}
+
+// readSelfSignedKey 读取 keyPath 中的私钥并检查类型，文件不存在时返回 os.ErrNotExist
+func readSelfSignedKey(keyPath, keyType string) (crypto.Signer, error) {
+	b, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: 不是 PEM 格式", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: 不支持的私钥类型", keyPath)
+	}
+	if t := keyTypeOf(signer); t != keyType {
+		return nil, fmt.Errorf("%s 的私钥类型为 %s，与 cert-key-type %s 不同：改回 %s，或移走该文件以生成新私钥（客户端的 pin-sha256 需要更新）", keyPath, t, keyType, t)
+	}
+	return signer, nil
+}
+
+// selfSignedPinSHA256 返回状态目录中已有私钥的公钥指纹，不创建目录、私钥或证书
+func selfSignedPinSHA256(c selfSignedConfig) ([]byte, error) {
+	keyPath := filepath.Join(c.Dir, selfSignedKeyFile)
+	signer, err := readSelfSignedKey(keyPath, c.KeyType)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s 不存在，请先启动一次服务器生成私钥", keyPath)
+	} else if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	spkiHash := sha256.Sum256(spki)
+	return spkiHash[:], nil
+}
+
+// loadCert 读取证书，返回需要重新签发的原因，为空表示证书可以继续使用
+func (s *selfSignedCert) loadCert() (reason string, err error) {
+	certPath := filepath.Join(s.dir, selfSignedCertFile)
+	b, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "首次生成", nil
+	} else if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return "证书文件无法解析", nil
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "证书文件无法解析", nil
+	}
+	switch {
+	case !publicKeyEqual(leaf.PublicKey, s.key.Public()):
+		return "私钥已变化", nil
+	case !slices.Equal(certNames(leaf), s.names):
+		return "SAN 已变化", nil
+	case time.Until(leaf.NotAfter) < s.renewBefore:
+		return "即将到期", nil
+	}
+	s.cert.Store(&tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: s.key, Leaf: leaf})
+	return "", nil
+}
+
+// issue 签发新证书并保存，调用方需持有 mu
+func (s *selfSignedCert) issue(reason string) error {
+	now := time.Now()
+	der, err := util.GenerateCertificate(s.key, s.names, now.Add(-time.Hour), now.Add(s.validity))
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(s.dir, selfSignedCertFile)
+	if err := writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	s.cert.Store(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: s.key, Leaf: leaf})
+	s.logFingerprints("已签发自签名证书（" + reason + "）")
+	return nil
+}
+
+// checkRenew 在证书即将到期时重新签发，新证书只作用于之后的 TLS 握手
+func (s *selfSignedCert) checkRenew() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Until(s.cert.Load().Leaf.NotAfter) >= s.renewBefore {
+		return
+	}
+	if err := s.issue("即将到期"); err != nil {
+		logrus.Errorln("[TLS] 轮换自签名证书失败（继续使用旧证书）:", err)
+	}
+}
+
+func (s *selfSignedCert) logFingerprints(prefix string) {
+	leaf := s.cert.Load().Leaf
+	certSHA256, spkiSHA256 := util.CertFingerprints(leaf)
+	logrus.Infof("[TLS] %s: %s，有效期至 %s", prefix, filepath.Join(s.dir, selfSignedCertFile), leaf.NotAfter.Format(time.DateTime))
+	logrus.Infoln("[TLS] 证书 SHA-256:", certSHA256)
+	logrus.Infoln("[TLS] 公钥 SHA-256（轮换后不变，推荐客户端 pin-sha256 使用）:", spkiSHA256)
+}
+
+// GetCertificate 供 tls.Config.GetCertificate 使用，始终返回最新签发的证书
+func (s *selfSignedCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// keyTypeOf 返回私钥对应的 --cert-key-type 取值
+func keyTypeOf(key crypto.Signer) string {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		return "ecdsa"
+	case ed25519.PrivateKey:
+		return "ed25519"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// certNames 按 GenerateCertificate 的顺序（域名在前，IP 在后）返回证书的 SAN
+func certNames(leaf *x509.Certificate) []string {
+	names := slices.Clone(leaf.DNSNames)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// writeFileAtomic 先写入临时文件再重命名，避免进程中断时留下不完整的文件
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// sortCertNames 把 SAN 排成证书中的顺序（域名在前，IP 在后），使配置与已有证书可以直接比较
+func sortCertNames(names []string) []string {
+	var dnsNames, ips []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip.String())
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	return append(dnsNames, ips...)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"anytls/util"
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedKeyType(t *testing.T) {
+	c := selfSignedConfig{
+		Dir:         filepath.Join(t.TempDir(), "cert"),
+		KeyType:     "ecdsa",
+		Names:       []string{"example.com"},
+		Validity:    util.Duration(time.Hour),
+		RenewBefore: util.Duration(time.Minute),
+	}
+
+	// --print-uri must not create the state directory
+	if _, err := selfSignedPinSHA256(c); err == nil {
+		t.Fatal("fingerprint of a missing key")
+	}
+	if _, err := os.Stat(c.Dir); !os.IsNotExist(err) {
+		t.Fatalf("state directory created: %v", err)
+	}
+
+	s, err := newSelfSignedCert(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := selfSignedPinSHA256(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(s.cert.Load().Leaf.RawSubjectPublicKeyInfo); !bytes.Equal(pin, want[:]) {
+		t.Error("fingerprint differs from the certificate's public key")
+	}
+
+	keyPath := filepath.Join(c.Dir, selfSignedKeyFile)
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.KeyType = "ed25519"
+	if _, err := newSelfSignedCert(c); err == nil {
+		t.Fatal("started with a key of another type")
+	}
+	if _, err := selfSignedPinSHA256(c); err == nil {
+		t.Error("fingerprint of a key of another type")
+	}
+	if after, err := os.ReadFile(keyPath); err != nil || !bytes.Equal(after, key) {
+		t.Errorf("key file changed after a key type mismatch: %v", err)
+	}
+}
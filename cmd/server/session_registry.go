@@ -0,0 +1,191 @@
+package main
+
+import (
+	"anytls"
+	"anytls/util"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sessionEntry 是注册表中一个已认证的会话
+type sessionEntry struct {
+	id      uint64
+	userID  int
+	remote  net.Addr
+	created time.Time
+	sess    *anytls.Session
+
+	// upload / download 累计该会话上已结束的 Stream 的字节数
+	upload   atomic.Int64
+	download atomic.Int64
+
+	// limiter 是该用户的限速器，nil 表示不限速
+	limiter *util.SpeedLimiter
+	// release 注销在线 IP 登记
+	release func()
+}
+
+// sessionRegistry 按用户 ID 登记所有存活的会话，
+// 用于在用户被移出面板用户表时踢下线
+type sessionRegistry struct {
+	counter atomic.Uint64
+
+	// mu 保护 sessions、byUser 与 goingAway
+	mu       sync.RWMutex
+	sessions map[uint64]*sessionEntry
+	byUser   map[int]map[uint64]*sessionEntry
+	// goingAway 在优雅退出开始后置位，之后登记的会话立即收到 cmdGoAway
+	goingAway bool
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[uint64]*sessionEntry),
+		byUser:   make(map[int]map[uint64]*sessionEntry),
+	}
+}
+
+// add 登记一个会话，会话结束时必须调用 remove
+func (r *sessionRegistry) add(userID int, remote net.Addr, sess *anytls.Session) *sessionEntry {
+	entry := &sessionEntry{
+		id:      r.counter.Add(1),
+		userID:  userID,
+		remote:  remote,
+		created: time.Now(),
+		sess:    sess,
+	}
+
+	r.mu.Lock()
+	r.sessions[entry.id] = entry
+	userSessions, exists := r.byUser[userID]
+	if !exists {
+		userSessions = make(map[uint64]*sessionEntry)
+		r.byUser[userID] = userSessions
+	}
+	userSessions[entry.id] = entry
+	goingAway := r.goingAway
+	r.mu.Unlock()
+
+	if goingAway {
+		go sess.GoAway()
+	}
+	return entry
+}
+
+// remove 注销一个会话
+func (r *sessionRegistry) remove(entry *sessionEntry) {
+	r.mu.Lock()
+	delete(r.sessions, entry.id)
+	if userSessions, exists := r.byUser[entry.userID]; exists {
+		delete(userSessions, entry.id)
+		if len(userSessions) == 0 {
+			delete(r.byUser, entry.userID)
+		}
+	}
+	r.mu.Unlock()
+}
+
+// userSessions 返回某个用户当前的所有会话
+func (r *sessionRegistry) userSessions(userID int) []*sessionEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries := make([]*sessionEntry, 0, len(r.byUser[userID]))
+	for _, entry := range r.byUser[userID] {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// get 按 ID 查找会话
+func (r *sessionRegistry) get(id uint64) (*sessionEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, exists := r.sessions[id]
+	return entry, exists
+}
+
+// list 返回所有存活的会话
+func (r *sessionRegistry) list() []*sessionEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries := make([]*sessionEntry, 0, len(r.sessions))
+	for _, entry := range r.sessions {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// userCount 返回拥有存活会话的用户数
+func (r *sessionRegistry) userCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.byUser)
+}
+
+// count 返回存活的会话数
+func (r *sessionRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+// streamCount 返回所有会话上打开的 Stream 总数
+func (r *sessionRegistry) streamCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var count int
+	for _, entry := range r.sessions {
+		count += entry.sess.StreamCount()
+	}
+	return count
+}
+
+// kickUsers 向这些用户的所有会话发送 cmdAlert 并关闭，返回被关闭的会话数
+func (r *sessionRegistry) kickUsers(userIDs []int, reason string) int {
+	var count int
+	for _, userID := range userIDs {
+		for _, entry := range r.userSessions(userID) {
+			count++
+			// Alert 最多阻塞到写超时，避免拖慢调用方
+			go entry.sess.Alert(reason)
+		}
+	}
+	if count > 0 {
+		logrus.Infof("[Server] 已关闭 %d 个用户的 %d 个会话: %s", len(userIDs), count, reason)
+	}
+	return count
+}
+
+// goAway 向所有会话发送 cmdGoAway，通知客户端不要再在这些会话上打开新的 Stream
+func (r *sessionRegistry) goAway() {
+	r.mu.Lock()
+	r.goingAway = true
+	r.mu.Unlock()
+
+	for _, entry := range r.list() {
+		go entry.sess.GoAway()
+	}
+}
+
+// closeAll 立即关闭所有会话
+func (r *sessionRegistry) closeAll() {
+	for _, entry := range r.list() {
+		entry.sess.Close()
+	}
+}
+
+// waitEmpty 等待所有会话结束，超时返回 false
+func (r *sessionRegistry) waitEmpty(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for r.count() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"anytls/auth"
+	"anytls/uri"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// printShareURIs 为每个用户输出 anytls:// 分享链接及终端二维码（--print-uri）。
+// host 是客户端连接的地址，留空时使用第一个监听地址中的主机。
+func printShareURIs(w io.Writer, cfg *serverConfig, host string) error {
+	var credentials []auth.Credential
+	switch {
+	case cfg.Auth.V2board.enabled():
+		return errors.New("V2board 模式的用户由面板管理，请在面板中获取订阅链接")
+	case cfg.Auth.Webhook.URL != "":
+		return errors.New("Webhook 模式下服务器不知道用户密码")
+	case cfg.Auth.UsersFile != "":
+		users, err := auth.NewFileAuthenticator(cfg.Auth.UsersFile)
+		if err != nil {
+			return fmt.Errorf("加载用户文件: %w", err)
+		}
+		credentials = users.Credentials()
+	default:
+		credentials = []auth.Credential{{Password: cfg.Auth.Password}}
+	}
+
+	listenHost, listenPort, err := net.SplitHostPort(cfg.Listeners[0])
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(listenPort, 10, 16)
+	if err != nil {
+		return fmt.Errorf("监听端口 %q: %w", listenPort, err)
+	}
+	if host == "" {
+		if ip := net.ParseIP(listenHost); listenHost == "" || (ip != nil && ip.IsUnspecified()) {
+			return errors.New("监听地址不含公网地址，请用 --uri-host 指定客户端连接的域名或 IP")
+		}
+		host = listenHost
+	}
+
+	link := &uri.URI{Host: host, Port: uint16(port)}
+	switch {
+	case cfg.TLS.Cert != "":
+		// 使用证书中的域名作为 SNI 并校验证书
+		names, err := certDNSNames(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(names, host) {
+			for _, name := range names {
+				if !strings.HasPrefix(name, "*.") {
+					link.SNI = name
+					break
+				}
+			}
+		}
+	case cfg.TLS.SelfSigned.Dir != "":
+		// 固定公钥指纹，证书轮换后链接仍然有效
+		pin, err := selfSignedPinSHA256(cfg.TLS.SelfSigned)
+		if err != nil {
+			return fmt.Errorf("加载自签名证书: %w", err)
+		}
+		link.PinSHA256 = [][]byte{pin}
+	default:
+		// 临时自签名证书无法校验
+		link.Insecure = true
+	}
+	if cfg.Padding.Scheme != "" {
+		b, err := os.ReadFile(cfg.Padding.Scheme)
+		if err != nil {
+			return fmt.Errorf("读取 padding-scheme 文件: %w", err)
+		}
+		link.Padding = b
+	}
+
+	for _, c := range credentials {
+		link.Password = c.Password
+		link.Name = c.Name
+		s := link.String()
+		qr, err := qrcode.New(s, qrcode.Medium)
+		if err != nil {
+			return err
+		}
+		if c.Name != "" {
+			fmt.Fprintf(w, "# %s\n", c.Name)
+		}
+		fmt.Fprintf(w, "%s\n%s\n", s, qr.ToSmallString(false))
+	}
+	return nil
+}
+
+// certDNSNames 返回证书链中叶子证书的 DNS 名称
+func certDNSNames(certFile, keyFile string) ([]string, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载证书: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("解析证书: %w", err)
+	}
+	return leaf.DNSNames, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownGracePeriod 是强制关闭会话后等待 Stream 处理函数完成流量记账的时间
+const shutdownGracePeriod = 5 * time.Second
+
+// waitForShutdown 阻塞直到收到 SIGTERM / SIGINT，然后优雅退出：
+// 停止接受新连接 -> 向所有会话发送 cmdGoAway -> 等待存量 Stream 结束（最多 drainTimeout）
+// -> 关闭剩余会话 -> 最后一次上报流量。退出期间再次收到信号则立即退出。
+func waitForShutdown(listeners []net.Listener, server *myServer, drainTimeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logrus.Infof("[Server] 收到 %v，停止接受新连接，等待存量连接结束（最多 %v）", sig, drainTimeout)
+
+	go func() {
+		sig := <-signals
+		logrus.Warnf("[Server] 再次收到 %v，立即退出", sig)
+		os.Exit(1)
+	}()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	server.sessions.goAway()
+	if !server.sessions.waitEmpty(drainTimeout) {
+		logrus.Warnf("[Server] 等待超时，强制关闭剩余的 %d 个会话", server.sessions.count())
+		server.sessions.closeAll()
+		server.sessions.waitEmpty(shutdownGracePeriod)
+	}
+
+	// 所有 Stream 均已记账，最后一次上报避免丢失计费流量（失败时 Push 内部已记录日志）
+	if server.v2boardTraffic != nil {
+		_ = server.v2boardTraffic.Push()
+	}
+	logrus.Infoln("[Server] 已退出")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"anytls/auth"
+	"anytls/proxy"
+	"anytls/proxy/padding"
+	"anytls/util"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sirupsen/logrus"
+)
+
+// clientHelloTimeout 是等待客户端发送 ClientHello 的超时时间
+const clientHelloTimeout = 10 * time.Second
+
+// sniRoutesConfig 是 --sni-routes 指定的 JSON 文件格式，也是配置文件中的 tls.sni
+type sniRoutesConfig struct {
+	// Routes 中列出的 SNI 在本机终止为 AnyTLS
+	Routes []sniRouteConfig `yaml:"routes" json:"routes"`
+	// DefaultUpstream 不为空时，其余 SNI（包括没有 SNI 的连接）原样转发到该地址；
+	// 为空时交给默认的 AnyTLS 服务处理
+	DefaultUpstream string `yaml:"default_upstream" json:"default_upstream"`
+}
+
+// sniRouteConfig 是单条 SNI 路由，每条路由拥有独立的证书、密码集合与填充方案
+type sniRouteConfig struct {
+	// ServerNames 是匹配的 SNI 列表，支持 *.example.com 形式的通配符
+	ServerNames []string `yaml:"server_names" json:"server_names"`
+	// Cert / Key 为 PEM 证书链与私钥文件，留空则生成自签名证书
+	Cert string `yaml:"cert" json:"cert"`
+	Key  string `yaml:"key" json:"key"`
+	// Passwords 是该路由接受的密码
+	Passwords []string `yaml:"passwords" json:"passwords"`
+	// PaddingScheme 是该路由使用的填充方案文件，留空则使用全局方案
+	PaddingScheme string `yaml:"padding_scheme" json:"padding_scheme"`
+}
+
+// sniRoute 是加载完成的 SNI 路由
+type sniRoute struct {
+	serverNames []string
+	server      *myServer
+	// paddingScheme 是该路由自己的填充方案文件，为空时使用全局方案
+	paddingScheme string
+}
+
+// sniRouter 在 TLS 握手之前读取 ClientHello，按 SNI 将连接分发给不同的 AnyTLS 服务或原样转发到上游
+type sniRouter struct {
+	routes          []*sniRoute
+	defaultUpstream string
+	defaultServer   *myServer
+}
+
+// loadSNIRoutesConfig 读取 --sni-routes 指定的路由表文件（JSON，也接受 YAML）
+func loadSNIRoutesConfig(path string) (*sniRoutesConfig, error) {
+	config := &sniRoutesConfig{}
+	if err := util.LoadConfigFile(path, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func newSNIRouter(ctx context.Context, config sniRoutesConfig, defaultServer *myServer) (*sniRouter, error) {
+	r := &sniRouter{
+		defaultUpstream: config.DefaultUpstream,
+		defaultServer:   defaultServer,
+	}
+	if r.defaultUpstream != "" {
+		if _, _, err := net.SplitHostPort(r.defaultUpstream); err != nil {
+			return nil, fmt.Errorf("default_upstream: %w", err)
+		}
+	}
+	for i, rc := range config.Routes {
+		route, err := newSNIRoute(ctx, rc, defaultServer)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		r.routes = append(r.routes, route)
+	}
+	return r, nil
+}
+
+func newSNIRoute(ctx context.Context, rc sniRouteConfig, defaultServer *myServer) (*sniRoute, error) {
+	if len(rc.ServerNames) == 0 {
+		return nil, errors.New("server_names 不能为空")
+	}
+	if len(rc.Passwords) == 0 {
+		return nil, errors.New("passwords 不能为空")
+	}
+
+	tlsConfig := &tls.Config{}
+	if rc.Cert != "" || rc.Key != "" {
+		if rc.Cert == "" || rc.Key == "" {
+			return nil, errors.New("cert 与 key 必须同时指定")
+		}
+		loader, err := newCertLoader(rc.Cert, rc.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = loader.GetCertificate
+		util.StartRoutine(ctx, certCheckInterval, loader.checkModified)
+	} else {
+		tlsCert, err := util.GenerateKeyPair(time.Now, strings.TrimPrefix(rc.ServerNames[0], "*."))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return tlsCert, nil
+		}
+	}
+
+	opts := serverOptions{
+		heartbeat:         defaultServer.heartbeat,
+		outbound:          defaultServer.outbound,
+		fallbackFunc:      defaultServer.fallbackFunc,
+		sessions:          defaultServer.sessions,
+		downstreamPadding: defaultServer.downstreamPadding,
+	}
+	if rc.PaddingScheme != "" {
+		rawScheme, err := os.ReadFile(rc.PaddingScheme)
+		if err != nil {
+			return nil, err
+		}
+		paddingF := padding.NewPaddingFactory(rawScheme)
+		if paddingF == nil {
+			return nil, fmt.Errorf("填充方案格式错误: %s", rc.PaddingScheme)
+		}
+		opts.padding = new(atomic.TypedValue[*padding.PaddingFactory])
+		opts.padding.Store(paddingF)
+	}
+
+	server, err := NewMyServer(tlsConfig, auth.NewPasswords(rc.Passwords...), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sniRoute{
+		serverNames:   rc.ServerNames,
+		server:        server,
+		paddingScheme: rc.PaddingScheme,
+	}, nil
+}
+
+// reloadPadding 重新读取该路由自己的填充方案文件，返回新方案的 md5
+func (r *sniRoute) reloadPadding() (string, error) {
+	rawScheme, err := os.ReadFile(r.paddingScheme)
+	if err != nil {
+		return "", err
+	}
+	paddingF := padding.NewPaddingFactory(rawScheme)
+	if paddingF == nil {
+		return "", fmt.Errorf("填充方案格式错误: %s", r.paddingScheme)
+	}
+	r.server.padding.Store(paddingF)
+	return paddingF.Md5, nil
+}
+
+// match 判断 serverName 是否命中该路由
+func (r *sniRoute) match(serverName string) bool {
+	for _, pattern := range r.serverNames {
+		if matchServerName(pattern, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchServerName 比较 SNI，支持 *.example.com 匹配任意一级子域名
+func matchServerName(pattern, serverName string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(serverName, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == serverName
+}
+
+// handleConnection 读取 ClientHello 并按 SNI 分发连接
+func (router *sniRouter) handleConnection(ctx context.Context, c net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorln("[BUG]", r, string(debug.Stack()))
+		}
+	}()
+
+	serverName, peeked, err := peekServerName(c)
+	if err != nil {
+		// 不是合法的 ClientHello（非 TLS 数据、HTTP 探测等）时不能直接断开，
+		// 否则与真实网站的表现不同；按没有 SNI 的连接交给默认上游或默认服务处理
+		logrus.Debugln("peekServerName:", err)
+		serverName = ""
+	}
+	// 回放已读出的数据，后续处理对此无感知
+	c = bufio.NewCachedConn(c, buf.As(peeked))
+
+	for _, route := range router.routes {
+		if route.match(serverName) {
+			route.server.serveConn(ctx, c)
+			return
+		}
+	}
+
+	if router.defaultUpstream != "" {
+		defer c.Close()
+		remote, err := proxy.SystemDialer.DialContext(ctx, "tcp", router.defaultUpstream)
+		if err != nil {
+			logrus.Debugln("sni upstream DialContext:", err)
+			return
+		}
+		defer remote.Close()
+		copyBidirectional(ctx, c, remote, nil)
+		return
+	}
+
+	router.defaultServer.serveConn(ctx, c)
+}
+
+// errClientHelloPeeked 用于在读到 ClientHello 后中止探测用的 TLS 握手
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// peekServerName 读取 ClientHello 并返回其中的 SNI（小写）以及读出的原始字节。
+// 借助 crypto/tls 解析 ClientHello，解析完成后立即中止握手，不会向客户端写入任何数据。
+// 解析失败时同样返回已读出的字节，供调用方回放。
+func peekServerName(c net.Conn) (serverName string, peeked []byte, err error) {
+	var recorded bytes.Buffer
+	c.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(readOnlyConn{io.TeeReader(c, &recorded)}, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = chi
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", recorded.Bytes(), err
+	}
+	return strings.ToLower(hello.ServerName), recorded.Bytes(), nil
+}
+
+// readOnlyConn 只允许读取的 net.Conn，写入被拒绝，用于 peekServerName
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
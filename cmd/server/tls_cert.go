@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certLoader 从磁盘加载 PEM 证书链与私钥，并在文件变化或收到 SIGHUP 时热重载。
+// 新证书只作用于之后的 TLS 握手，已建立的会话不受影响。
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	cert atomic.Pointer[tls.Certificate]
+
+	// mu 保护 certStat / keyStat，串行化重载过程
+	mu       sync.Mutex
+	certStat fileStamp
+	keyStat  fileStamp
+}
+
+// fileStamp 记录文件的修改时间与大小，用于判断文件是否变化
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(name string) (fileStamp, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// newCertLoader 创建证书加载器并立即加载一次，首次加载失败直接返回错误
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reload 重新读取证书与私钥文件。失败时保留旧证书继续服务。
+func (l *certLoader) reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	certStat, err := statFile(l.certFile)
+	if err != nil {
+		return fmt.Errorf("读取证书文件: %w", err)
+	}
+	keyStat, err := statFile(l.keyFile)
+	if err != nil {
+		return fmt.Errorf("读取私钥文件: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("加载证书: %w", err)
+	}
+
+	l.cert.Store(&cert)
+	l.certStat = certStat
+	l.keyStat = keyStat
+	return nil
+}
+
+// checkModified 检查证书或私钥文件是否变化，变化则重载
+func (l *certLoader) checkModified() {
+	certStat, err1 := statFile(l.certFile)
+	keyStat, err2 := statFile(l.keyFile)
+	if err1 != nil || err2 != nil {
+		// 文件可能正在被替换，等待下一轮检查
+		return
+	}
+
+	l.mu.Lock()
+	changed := certStat != l.certStat || keyStat != l.keyStat
+	l.mu.Unlock()
+
+	if changed {
+		if err := l.reload(); err != nil {
+			logrus.Errorln("[TLS] 证书重载失败（继续使用旧证书）:", err)
+			return
+		}
+		logrus.Infoln("[TLS] 证书文件已变化，重新加载:", l.certFile)
+	}
+}
+
+// GetCertificate 供 tls.Config.GetCertificate 使用，始终返回最新加载的证书
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.cert.Load(), nil
+}
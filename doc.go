@@ -0,0 +1,25 @@
+// Package anytls embeds the AnyTLS protocol in Go programs.
+//
+// A Client keeps a pool of sessions to one server and opens a stream per
+// DialContext call:
+//
+//	client, err := anytls.NewClient(ctx, anytls.ClientConfig{
+//		Server:   "example.com:443",
+//		Password: "password",
+//	})
+//	conn, err := client.DialContext(ctx, "tcp", "example.org:80")
+//
+// A Server accepts TLS connections on a net.Listener, authenticates them and
+// hands every stream with its destination to a Handler:
+//
+//	server, err := anytls.Listen("tcp", ":8443", anytls.ServerConfig{
+//		TLSConfig: tlsConfig,
+//		Passwords: []string{"password"},
+//		Handler: func(ctx context.Context, s *anytls.Session, stream net.Conn, destination M.Socksaddr) {
+//			...
+//		},
+//	})
+//	err = server.Serve()
+//
+// Dial and Listen are shorthands for a single connection and a single listener.
+package anytls
@@ -0,0 +1,219 @@
+// Package geodata reads the geoip.dat and geosite.dat files used by v2ray and
+// its forks, e.g. the ones published by Loyalsoldier/v2ray-rules-dat.
+//
+// Both files are protobuf messages; only the entries asked for are decoded.
+package geodata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// DomainType is how a geosite domain entry matches
+type DomainType int
+
+const (
+	// DomainKeyword matches domains containing the value
+	DomainKeyword DomainType = iota
+	// DomainRegex matches domains against the value as a regular expression
+	DomainRegex
+	// DomainSuffix matches the value and its subdomains
+	DomainSuffix
+	// DomainFull matches the value only
+	DomainFull
+)
+
+// Domain is one entry of a geosite category
+type Domain struct {
+	Type  DomainType
+	Value string
+}
+
+// LoadGeoIP returns the CIDRs of each requested country code (case-insensitive)
+// in a geoip.dat file. A code missing from the file is an error.
+func LoadGeoIP(path string, codes []string) (map[string][]netip.Prefix, error) {
+	result := make(map[string][]netip.Prefix)
+	err := loadEntries(path, codes, func(code string, entry []byte) error {
+		var prefixes []netip.Prefix
+		err := walk(entry, func(field int, data []byte, _ uint64) error {
+			if field != 2 {
+				return nil
+			}
+			prefix, err := decodeCIDR(data)
+			if err != nil {
+				return err
+			}
+			prefixes = append(prefixes, prefix)
+			return nil
+		})
+		result[code] = append(result[code], prefixes...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LoadGeoSite returns the domain entries of each requested category
+// (case-insensitive) in a geosite.dat file. A category missing from the file is an error.
+func LoadGeoSite(path string, codes []string) (map[string][]Domain, error) {
+	result := make(map[string][]Domain)
+	err := loadEntries(path, codes, func(code string, entry []byte) error {
+		var domains []Domain
+		err := walk(entry, func(field int, data []byte, _ uint64) error {
+			if field != 2 {
+				return nil
+			}
+			domain, err := decodeDomain(data)
+			if err != nil {
+				return err
+			}
+			domains = append(domains, domain)
+			return nil
+		})
+		result[code] = append(result[code], domains...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// loadEntries calls f with each top level entry whose country_code is in codes.
+// Both files are a list of entries (field 1) that start with country_code (field 1).
+func loadEntries(path string, codes []string, f func(code string, entry []byte) error) error {
+	wanted := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		wanted[strings.ToLower(code)] = true
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(codes))
+	err = walk(content, func(field int, entry []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		var code string
+		err := walk(entry, func(field int, data []byte, _ uint64) error {
+			if field == 1 {
+				code = strings.ToLower(string(data))
+				return errStop
+			}
+			return nil
+		})
+		if err != nil && err != errStop {
+			return err
+		}
+		if !wanted[code] {
+			return nil
+		}
+		found[code] = true
+		return f(code, entry)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for code := range wanted {
+		if !found[code] {
+			return fmt.Errorf("%s: %s not found", path, code)
+		}
+	}
+	return nil
+}
+
+// decodeCIDR decodes CIDR{bytes ip = 1; uint32 prefix = 2}
+func decodeCIDR(b []byte) (netip.Prefix, error) {
+	var ip []byte
+	var bits uint64
+	err := walk(b, func(field int, data []byte, value uint64) error {
+		switch field {
+		case 1:
+			ip = data
+		case 2:
+			bits = value
+		}
+		return nil
+	})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || bits > uint64(addr.BitLen()) {
+		return netip.Prefix{}, errors.New("invalid CIDR")
+	}
+	return netip.PrefixFrom(addr, int(bits)).Masked(), nil
+}
+
+// decodeDomain decodes Domain{Type type = 1; string value = 2}
+func decodeDomain(b []byte) (Domain, error) {
+	var domain Domain
+	err := walk(b, func(field int, data []byte, value uint64) error {
+		switch field {
+		case 1:
+			if value > uint64(DomainFull) {
+				return fmt.Errorf("unknown domain type %d", value)
+			}
+			domain.Type = DomainType(value)
+		case 2:
+			domain.Value = string(data)
+		}
+		return nil
+	})
+	return domain, err
+}
+
+var errStop = errors.New("stop")
+
+// walk calls f for each field of a protobuf message. data is set for
+// length-delimited fields and value for varint fields, others are skipped.
+func walk(b []byte, f func(field int, data []byte, value uint64) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed protobuf")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var data []byte
+		var value uint64
+		switch key & 7 {
+		case 0: // varint
+			value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("malformed protobuf")
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return errors.New("malformed protobuf")
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errors.New("malformed protobuf")
+			}
+			data = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return errors.New("malformed protobuf")
+			}
+			b = b[4:]
+		default:
+			return errors.New("malformed protobuf")
+		}
+		if err := f(field, data, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
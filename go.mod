@@ -6,6 +6,8 @@ require (
 	github.com/chen3feng/stl4go v0.1.1
 	github.com/sagernet/sing v0.5.1
 	github.com/sirupsen/logrus v1.9.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/sys v0.29.0 // indirect
@@ -17,6 +17,8 @@ DOWNLOAD_URL=""
 INSTALL_DIR="/usr/local/bin"
 BINARY_NAME="anytls-server"
 SERVICE_NAME="anytls"
+CONFIG_DIR="/etc/anytls"
+CONFIG_FILE="${CONFIG_DIR}/config.yaml"
 GITHUB_REPO="code-gopher/anytls-go"
 
 #----------------------------------------------------------------
@@ -54,10 +56,16 @@ parse_arguments() {
         echo "错误：必须提供 --apiHost、--apiKey、--nodeID 三个参数"
         show_usage
     fi
+    case $NODEID in
+        *[!0-9]*)
+            echo "错误：--nodeID 必须是数字"
+            show_usage
+            ;;
+    esac
 
     echo "==> 配置参数："
     echo "    apiHost = ${APIHOST}"
-    echo "    apiKey  = ${APIKEY}"
+    echo "    apiKey  = ******"
     echo "    nodeID  = ${NODEID}"
     echo ""
 }
@@ -178,6 +186,45 @@ install_binary() {
     echo ""
 }
 
+#----------------------------------------------------------------
+# 函数：输出 YAML 双引号字符串，转义其中的反斜杠与双引号
+#----------------------------------------------------------------
+yaml_quote() {
+    printf '"%s"' "$(printf '%s' "$1" | sed -e 's/\\/\\\\/g' -e 's/"/\\"/g')"
+}
+
+#----------------------------------------------------------------
+# 函数：写入配置文件（仅 root 可读，避免 API 密钥出现在服务文件与进程参数中）
+# 配置文件已存在时（重复安装、升级）保留原文件，不覆盖管理员的修改
+#----------------------------------------------------------------
+write_config() {
+    echo "==> 写入配置文件..."
+
+    if [ -f "${CONFIG_FILE}" ]; then
+        echo "    配置文件已存在，保留原文件：${CONFIG_FILE}"
+        echo "    如需使用本次的参数，请手动修改该文件或删除后重新运行脚本"
+        echo ""
+        return
+    fi
+
+    mkdir -p "${CONFIG_DIR}"
+    chmod 700 "${CONFIG_DIR}"
+    (
+        umask 077
+        cat > "${CONFIG_FILE}" <<EOF
+auth:
+  v2board:
+    api_host: $(yaml_quote "${APIHOST}")
+    api_key: $(yaml_quote "${APIKEY}")
+    node_id: ${NODEID}
+EOF
+    )
+    chmod 600 "${CONFIG_FILE}"
+
+    echo "    配置文件：${CONFIG_FILE}"
+    echo ""
+}
+
 #----------------------------------------------------------------
 # 函数：配置 systemd 服务
 #----------------------------------------------------------------
@@ -191,10 +238,7 @@ After=network.target
 
 [Service]
 Type=simple
-ExecStart=${INSTALL_DIR}/${BINARY_NAME} \\
-    --v2board-api-host ${APIHOST} \\
-    --v2board-api-key ${APIKEY} \\
-    --v2board-node-id ${NODEID}
+ExecStart=${INSTALL_DIR}/${BINARY_NAME} -c ${CONFIG_FILE}
 Restart=on-failure
 RestartSec=5s
 LimitNOFILE=1048576
@@ -223,7 +267,7 @@ configure_openrc_service() {
 name="${SERVICE_NAME}"
 description="AnyTLS Server"
 command="${INSTALL_DIR}/${BINARY_NAME}"
-command_args="--v2board-api-host ${APIHOST} --v2board-api-key ${APIKEY} --v2board-node-id ${NODEID}"
+command_args="-c ${CONFIG_FILE}"
 pidfile="/var/run/${SERVICE_NAME}.pid"
 command_background="yes"
 
@@ -259,6 +303,8 @@ show_completion_message() {
     echo "✓ AnyTLS Server 安装完成！"
     echo "================================================"
     echo ""
+    echo "配置文件：${CONFIG_FILE}"
+    echo ""
     echo "服务管理命令："
     if [ "$SYSTEM_TYPE" = "systemd" ]; then
         echo "  查看状态：systemctl status ${SERVICE_NAME}"
@@ -296,6 +342,7 @@ main() {
     get_latest_version
     download_binary
     install_binary
+    write_config
     configure_service
     show_completion_message
 }
@@ -0,0 +1,289 @@
+// Package metrics is a minimal Prometheus-compatible metrics registry.
+// It only implements what anytls needs: counters, labeled counters,
+// gauges backed by a callback and summaries without quantiles.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]collector)
+)
+
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, exists := registry[c.name()]; exists {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	registry[c.name()] = c
+}
+
+// WriteTo writes all registered metrics in the Prometheus text format.
+func WriteTo(w io.Writer) {
+	registryLock.Lock()
+	collectors := make([]collector, 0, len(registry))
+	for _, c := range registry {
+		collectors = append(collectors, c)
+	}
+	registryLock.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// ListenAndServe serves /metrics on addr. It blocks like http.ListenAndServe.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	metricName string
+	help       string
+	value      atomic.Uint64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc()          { c.value.Add(1) }
+func (c *Counter) Add(n uint64)  { c.value.Add(n) }
+func (c *Counter) Value() uint64 { return c.value.Load() }
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.metricName, c.value.Load())
+}
+
+// vec holds the children of a labeled metric.
+type vec[T any] struct {
+	metricName string
+	help       string
+	labelNames []string
+
+	mu       sync.RWMutex
+	children map[string]*vecChild[T]
+	newChild func() *T
+}
+
+type vecChild[T any] struct {
+	labelValues []string
+	value       *T
+}
+
+func (v *vec[T]) with(labelValues []string) *T {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.RLock()
+	child, exists := v.children[key]
+	v.mu.RUnlock()
+	if exists {
+		return child.value
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, exists = v.children[key]; !exists {
+		child = &vecChild[T]{labelValues: append([]string(nil), labelValues...), value: v.newChild()}
+		v.children[key] = child
+	}
+	return child.value
+}
+
+func (v *vec[T]) sortedChildren() []*vecChild[T] {
+	v.mu.RLock()
+	children := make([]*vecChild[T], 0, len(v.children))
+	for _, child := range v.children {
+		children = append(children, child)
+	}
+	v.mu.RUnlock()
+	sort.Slice(children, func(i, j int) bool {
+		return strings.Join(children[i].labelValues, "\xff") < strings.Join(children[j].labelValues, "\xff")
+	})
+	return children
+}
+
+func (v *vec[T]) name() string { return v.metricName }
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec[atomic.Uint64]
+}
+
+// NewCounterVec creates and registers a labeled counter.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{vec[atomic.Uint64]{
+		metricName: name,
+		help:       help,
+		labelNames: labelNames,
+		children:   make(map[string]*vecChild[atomic.Uint64]),
+		newChild:   func() *atomic.Uint64 { return new(atomic.Uint64) },
+	}}
+	register(c)
+	return c
+}
+
+// Add adds n to the counter with the given label values.
+func (c *CounterVec) Add(n uint64, labelValues ...string) {
+	c.with(labelValues).Add(n)
+}
+
+// Inc increments the counter with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.with(labelValues).Add(1)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	for _, child := range c.sortedChildren() {
+		fmt.Fprintf(w, "%s%s %d\n", c.metricName, formatLabels(c.labelNames, child.labelValues), child.value.Load())
+	}
+}
+
+// GaugeFunc is a gauge whose value is read from a callback on every scrape.
+type GaugeFunc struct {
+	metricName string
+	help       string
+	f          func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge backed by f.
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, f: f}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string { return g.metricName }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.f()))
+}
+
+// summary accumulates the sum and count of observations.
+type summary struct {
+	mu    sync.Mutex
+	sum   float64
+	count uint64
+}
+
+func (s *summary) observe(v float64) {
+	s.mu.Lock()
+	s.sum += v
+	s.count++
+	s.mu.Unlock()
+}
+
+// SummaryVec is a labeled summary that only exposes _sum and _count.
+type SummaryVec struct {
+	vec[summary]
+}
+
+// NewSummaryVec creates and registers a labeled summary.
+func NewSummaryVec(name, help string, labelNames ...string) *SummaryVec {
+	s := &SummaryVec{vec[summary]{
+		metricName: name,
+		help:       help,
+		labelNames: labelNames,
+		children:   make(map[string]*vecChild[summary]),
+		newChild:   func() *summary { return new(summary) },
+	}}
+	register(s)
+	return s
+}
+
+// Observe records one observation with the given label values.
+func (s *SummaryVec) Observe(v float64, labelValues ...string) {
+	s.with(labelValues).observe(v)
+}
+
+func (s *SummaryVec) write(w io.Writer) {
+	writeHeader(w, s.metricName, s.help, "summary")
+	for _, child := range s.sortedChildren() {
+		labels := formatLabels(s.labelNames, child.labelValues)
+		child.value.mu.Lock()
+		sum, count := child.value.sum, child.value.count
+		child.value.mu.Unlock()
+		fmt.Fprintf(w, "%s_sum%s %s\n", s.metricName, labels, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", s.metricName, labels, count)
+	}
+}
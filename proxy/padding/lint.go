@@ -0,0 +1,206 @@
+package padding
+
+import (
+	"anytls/util"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LintIssue is a line of a scheme that is ignored, in whole or in part.
+// Line is 1-based, 0 for problems of the scheme as a whole.
+type LintIssue struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+func (i LintIssue) String() string {
+	if i.Line == 0 {
+		return i.Reason
+	}
+	return fmt.Sprintf("line %d: %q: %s", i.Line, i.Text, i.Reason)
+}
+
+// Lint reports what NewPaddingFactory and GenerateRecordPayloadSizes silently
+// ignore in rawScheme. A scheme without issues is used exactly as written.
+func Lint(rawScheme []byte) (issues []LintIssue) {
+	scheme := util.StringMapFromBytes(rawScheme)
+	v2 := scheme[versionKey] == "2"
+	p := NewPaddingFactory(rawScheme)
+	if p == nil {
+		issues = append(issues, LintIssue{Reason: "scheme is invalid: a numeric stop is required"})
+	}
+
+	lastLine := make(map[string]int)
+	lines := strings.Split(string(rawScheme), "\n")
+	for i, line := range lines {
+		if k, _, found := strings.Cut(line, "="); found {
+			lastLine[k] = i + 1
+		}
+	}
+
+	for i, line := range lines {
+		issue := func(format string, a ...any) {
+			issues = append(issues, LintIssue{Line: i + 1, Text: line, Reason: fmt.Sprintf(format, a...)})
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasSuffix(line, "\r") {
+			issue("CRLF line ending, the value includes \\r")
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			issue("no key=value, line ignored")
+			continue
+		}
+		if lastLine[key] != i+1 {
+			issue("key repeated on line %d, line ignored", lastLine[key])
+			continue
+		}
+		var reasons []string
+		if v2 {
+			reasons = lintLineV2(key, value)
+		} else {
+			reasons = lintLineV1(key, value)
+		}
+		for _, reason := range reasons {
+			issue("%s", reason)
+		}
+		if len(reasons) == 0 && p != nil {
+			if reason := lintPacketUse(p, v2, key); reason != "" {
+				issue("%s", reason)
+			}
+		}
+	}
+	return
+}
+
+// lintPacketUse reports packet rules that writeConn never reaches
+func lintPacketUse(p *PaddingFactory, v2 bool, key string) string {
+	views := []*PaddingFactory{p}
+	var isDelay bool
+	if v2 {
+		switch {
+		case strings.HasPrefix(key, "up."):
+			key = strings.TrimPrefix(key, "up.")
+		case strings.HasPrefix(key, "down."):
+			key = strings.TrimPrefix(key, "down.")
+			views = []*PaddingFactory{p.ForDirection(Downstream)}
+		default:
+			views = append(views, p.ForDirection(Downstream))
+		}
+		key, isDelay = strings.CutPrefix(key, "delay.")
+	}
+	pkt, ok := parsePacketKey(key)
+	if !ok {
+		return ""
+	}
+	for _, view := range views {
+		if pkt < view.Stop {
+			return ""
+		}
+		if r := view.rules; !isDelay && r != nil && r.repeat && pkt >= r.repeatFrom && pkt <= r.repeatTo {
+			return ""
+		}
+	}
+	if isDelay {
+		return fmt.Sprintf("packet %d is not below stop and delays are not repeated, line ignored", pkt)
+	}
+	return fmt.Sprintf("packet %d is not below stop and not repeated, line ignored", pkt)
+}
+
+func lintLineV1(key, value string) (reasons []string) {
+	if key == "stop" {
+		if _, err := strconv.Atoi(value); err != nil {
+			reasons = append(reasons, "stop is not a number")
+		}
+		return
+	}
+	if key == versionKey {
+		return []string{"only version=2 is understood, line ignored"}
+	}
+	if _, ok := parsePacketKey(key); !ok {
+		return []string{"unknown key, line ignored"}
+	}
+	for _, token := range strings.Split(value, ",") {
+		if token == "c" {
+			continue
+		}
+		minMax := strings.Split(token, "-")
+		if len(minMax) != 2 {
+			reasons = append(reasons, fmt.Sprintf("%q is not a min-max range, ignored (fixed sizes need version=2)", token))
+			continue
+		}
+		if reason := lintRange(minMax[0], minMax[1]); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("%q %s, ignored", token, reason))
+		}
+	}
+	return
+}
+
+func lintLineV2(key, value string) (reasons []string) {
+	if key == versionKey {
+		return nil
+	}
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "up."), "down.")
+	switch {
+	case key == "stop":
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			reasons = append(reasons, "stop is not a number")
+		}
+	case key == "repeat":
+		if _, _, ok := parseUintRange(value); !ok {
+			reasons = append(reasons, "repeat is not a packet range such as 4-7, line ignored")
+		}
+	case strings.HasPrefix(key, "delay."):
+		if _, ok := parsePacketKey(strings.TrimPrefix(key, "delay.")); !ok {
+			reasons = append(reasons, "delay is not followed by a packet number, line ignored")
+		} else if _, ok := parseDelay(value); !ok {
+			reasons = append(reasons, fmt.Sprintf("delay is not a duration range within %s, line ignored", maxRecordDelay))
+		}
+	default:
+		if _, ok := parsePacketKey(key); !ok {
+			return []string{"unknown key, line ignored"}
+		}
+		for _, token := range strings.Split(value, ",") {
+			if parseSizeToken(token) != nil {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(token, "w("):
+				reasons = append(reasons, fmt.Sprintf("%q is not a valid weighted choice, ignored", token))
+			case strings.HasPrefix(token, "n("):
+				reasons = append(reasons, fmt.Sprintf("%q is not a valid normal distribution, ignored", token))
+			default:
+				a, b, found := strings.Cut(token, "-")
+				if !found {
+					b = a
+				}
+				reason := lintRange(a, b)
+				if reason == "" {
+					reason = "cannot be parsed"
+				}
+				reasons = append(reasons, fmt.Sprintf("%q %s, ignored", token, reason))
+			}
+		}
+	}
+	return
+}
+
+func lintRange(a, b string) string {
+	_min, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return "is not numeric"
+	}
+	_max, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return "is not numeric"
+	}
+	if min(_min, _max) <= 0 {
+		return "is zero or negative"
+	}
+	return ""
+}
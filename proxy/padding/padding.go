@@ -8,6 +8,7 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sagernet/sing/common/atomic"
 )
@@ -24,17 +25,38 @@ var defaultPaddingScheme = []byte(`stop=8
 6=500-1000
 7=500-1000`)
 
+// defaultDownstreamPaddingScheme is applied by the server to the traffic it sends.
+// The server has no authentication packet, so its first write is packet 0.
+var defaultDownstreamPaddingScheme = []byte(`stop=6
+0=100-400
+1=200-500
+2=500-1000,c,500-1000,c,500-1000,c,500-1000
+3=500-1000,c,500-1000
+4=500-1000
+5=500-1000`)
+
 type PaddingFactory struct {
 	scheme    util.StringMap
 	RawScheme []byte
 	Stop      uint32
 	Md5       string
+	// Version is 2 for schemes starting with "version=2" and 1 for legacy schemes
+	Version int
+
+	// version 2 rules of this direction, and of the downstream direction when
+	// the scheme has "down." keys
+	rules *rulesV2
+	down  *PaddingFactory
 }
 
 var DefaultPaddingFactory atomic.TypedValue[*PaddingFactory]
 
+// DefaultDownstreamPaddingFactory is the scheme of the server-to-client direction.
+var DefaultDownstreamPaddingFactory atomic.TypedValue[*PaddingFactory]
+
 func init() {
 	UpdatePaddingScheme(defaultPaddingScheme)
+	UpdateDownstreamPaddingScheme(defaultDownstreamPaddingScheme)
 }
 
 func UpdatePaddingScheme(rawScheme []byte) bool {
@@ -45,6 +67,14 @@ func UpdatePaddingScheme(rawScheme []byte) bool {
 	return false
 }
 
+func UpdateDownstreamPaddingScheme(rawScheme []byte) bool {
+	if p := NewPaddingFactory(rawScheme); p != nil {
+		DefaultDownstreamPaddingFactory.Store(p)
+		return true
+	}
+	return false
+}
+
 func NewPaddingFactory(rawScheme []byte) *PaddingFactory {
 	p := &PaddingFactory{
 		RawScheme: rawScheme,
@@ -54,6 +84,15 @@ func NewPaddingFactory(rawScheme []byte) *PaddingFactory {
 	if len(scheme) == 0 {
 		return nil
 	}
+	if scheme[versionKey] == "2" {
+		p.Version = 2
+		p.scheme = scheme
+		if !p.parseV2(scheme) {
+			return nil
+		}
+		return p
+	}
+	p.Version = 1
 	if stop, err := strconv.Atoi(scheme["stop"]); err == nil {
 		p.Stop = uint32(stop)
 	} else {
@@ -63,7 +102,39 @@ func NewPaddingFactory(rawScheme []byte) *PaddingFactory {
 	return p
 }
 
+// ForDirection returns the rules used for traffic in direction d. Only version 2
+// schemes can have different rules per direction.
+func (p *PaddingFactory) ForDirection(d Direction) *PaddingFactory {
+	if d == Downstream && p.down != nil {
+		return p.down
+	}
+	return p
+}
+
+// HasDirection reports whether the scheme has its own rules for direction d
+func (p *PaddingFactory) HasDirection(d Direction) bool {
+	return d == Upstream || p.down != nil
+}
+
+// Active reports whether packet pkt is still shaped by the scheme. Once it
+// returns false it does so for all later packets.
+func (p *PaddingFactory) Active(pkt uint32) bool {
+	return pkt < p.Stop || (p.rules != nil && p.rules.repeat)
+}
+
+// RecordDelay returns the wait added by each record of packet pkt, which is
+// zero from stop on
+func (p *PaddingFactory) RecordDelay(pkt uint32) time.Duration {
+	if p.rules == nil {
+		return 0
+	}
+	return p.rules.recordDelay(pkt, p.Stop)
+}
+
 func (p *PaddingFactory) GenerateRecordPayloadSizes(pkt uint32) (pktSizes []int) {
+	if p.rules != nil {
+		return p.rules.recordSizes(pkt, p.Stop)
+	}
 	if s, ok := p.scheme[strconv.Itoa(int(pkt))]; ok {
 		sRanges := strings.Split(s, ",")
 		for _, sRange := range sRanges {
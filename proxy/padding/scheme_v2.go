@@ -0,0 +1,360 @@
+package padding
+
+import (
+	"anytls/util"
+	"crypto/rand"
+	"math"
+	"math/big"
+	mrand "math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version 2 schemes start with a "version=2" line and extend the legacy format:
+//
+//	version=2
+//	stop=8
+//	0=30-30
+//	1=100-400
+//	2=400-500,c,w(500-1000:3;1200-1400:1),c,n(900;150;500-1400)
+//	3=9,500-1000
+//	delay.2=5ms-20ms
+//	repeat=4-7
+//	down.stop=4
+//	down.0=200-600
+//
+// Record sizes are a fixed "n", a uniform "min-max", a weighted choice
+// "w(size:weight;...)" or a normal distribution "n(mean;stddev[;min-max])".
+// "delay.N" adds a wait for every record of packet N, the sum is waited before
+// the packet is written and capped by the session. "repeat=a-b" keeps padding
+// after stop by cycling through the record sizes of packets a..b; delays are
+// not repeated, so they are bounded by the packets below stop. Keys prefixed with
+// "up." or "down." only apply to that direction and override unprefixed ones.
+// Tokens and lines that cannot be parsed are ignored, as in legacy schemes.
+
+// Direction selects the rules of a scheme used for one side of the connection.
+type Direction int
+
+const (
+	// Upstream is the client to server direction
+	Upstream Direction = iota
+	// Downstream is the server to client direction
+	Downstream
+)
+
+const (
+	versionKey = "version"
+	// maxRecordDelay bounds delay.N, longer delays are ignored
+	maxRecordDelay = time.Second
+	// maxRecordSize bounds the records of normal distributions
+	maxRecordSize = 65535
+)
+
+type sizeGen func() int
+
+type delayRange struct {
+	min, max time.Duration
+}
+
+// rulesV2 is one direction of a version 2 scheme
+type rulesV2 struct {
+	sizes      map[uint32][]sizeGen
+	delays     map[uint32]delayRange
+	repeat     bool
+	repeatFrom uint32
+	repeatTo   uint32
+}
+
+// parseV2 fills p with the upstream rules and, when the scheme has "down."
+// keys, p.down with the downstream rules. It returns false if a direction
+// has no valid stop.
+func (p *PaddingFactory) parseV2(scheme util.StringMap) bool {
+	base, up, down := util.StringMap{}, util.StringMap{}, util.StringMap{}
+	for k, v := range scheme {
+		switch {
+		case k == versionKey:
+		case strings.HasPrefix(k, "up."):
+			up[strings.TrimPrefix(k, "up.")] = v
+		case strings.HasPrefix(k, "down."):
+			down[strings.TrimPrefix(k, "down.")] = v
+		default:
+			base[k] = v
+		}
+	}
+
+	var ok bool
+	if p.Stop, p.rules, ok = buildRulesV2(base, up); !ok {
+		return false
+	}
+	if len(down) > 0 {
+		p.down = &PaddingFactory{
+			RawScheme: p.RawScheme,
+			Md5:       p.Md5,
+			Version:   p.Version,
+		}
+		if p.down.Stop, p.down.rules, ok = buildRulesV2(base, down); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func buildRulesV2(base, override util.StringMap) (stop uint32, r *rulesV2, ok bool) {
+	m := make(util.StringMap, len(base)+len(override))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range override {
+		m[k] = v
+	}
+
+	s, err := strconv.ParseUint(m["stop"], 10, 32)
+	if err != nil {
+		return 0, nil, false
+	}
+	r = &rulesV2{
+		sizes:  make(map[uint32][]sizeGen),
+		delays: make(map[uint32]delayRange),
+	}
+	for k, v := range m {
+		if k == "stop" {
+			continue
+		}
+		if k == "repeat" {
+			if from, to, ok := parseUintRange(v); ok {
+				r.repeat, r.repeatFrom, r.repeatTo = true, from, to
+			}
+			continue
+		}
+		if pktKey, ok := strings.CutPrefix(k, "delay."); ok {
+			pkt, ok := parsePacketKey(pktKey)
+			if !ok {
+				continue
+			}
+			if d, ok := parseDelay(v); ok {
+				r.delays[pkt] = d
+			}
+			continue
+		}
+		pkt, ok := parsePacketKey(k)
+		if !ok {
+			continue
+		}
+		var gens []sizeGen
+		for _, token := range strings.Split(v, ",") {
+			if gen := parseSizeToken(token); gen != nil {
+				gens = append(gens, gen)
+			}
+		}
+		r.sizes[pkt] = gens
+	}
+	return uint32(s), r, true
+}
+
+// parsePacketKey accepts the canonical decimal form only, like the legacy lookup
+func parsePacketKey(s string) (uint32, bool) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || strconv.FormatUint(n, 10) != s {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+func parseUintRange(s string) (from, to uint32, ok bool) {
+	a, b, found := strings.Cut(s, "-")
+	if !found {
+		b = a
+	}
+	x, err := strconv.ParseUint(a, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	y, err := strconv.ParseUint(b, 10, 32)
+	if err != nil || max(x, y)-min(x, y) == math.MaxUint32 {
+		return 0, 0, false
+	}
+	return uint32(min(x, y)), uint32(max(x, y)), true
+}
+
+func parseDelay(s string) (delayRange, bool) {
+	a, b, found := strings.Cut(s, "-")
+	if !found {
+		b = a
+	}
+	x, err := time.ParseDuration(a)
+	if err != nil {
+		return delayRange{}, false
+	}
+	y, err := time.ParseDuration(b)
+	if err != nil {
+		return delayRange{}, false
+	}
+	d := delayRange{min: min(x, y), max: max(x, y)}
+	if d.min < 0 || d.max > maxRecordDelay {
+		return delayRange{}, false
+	}
+	return d, true
+}
+
+// parseSizeToken returns nil for tokens that cannot be parsed
+func parseSizeToken(token string) sizeGen {
+	switch {
+	case token == "c":
+		return func() int { return CheckMark }
+	case strings.HasPrefix(token, "w(") && strings.HasSuffix(token, ")"):
+		return parseWeighted(token[2 : len(token)-1])
+	case strings.HasPrefix(token, "n(") && strings.HasSuffix(token, ")"):
+		return parseNormal(token[2 : len(token)-1])
+	default:
+		return parseUniform(token)
+	}
+}
+
+// parseUniform parses "min-max" or a fixed "n"
+func parseUniform(s string) sizeGen {
+	a, b, found := strings.Cut(s, "-")
+	if !found {
+		b = a
+	}
+	_min, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return nil
+	}
+	_max, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return nil
+	}
+	_min, _max = min(_min, _max), max(_min, _max)
+	if _min <= 0 || _max <= 0 {
+		return nil
+	}
+	if _min == _max {
+		return func() int { return int(_min) }
+	}
+	return func() int { return int(randInt64(_max-_min) + _min) }
+}
+
+// parseWeighted parses "size:weight;size:weight", the weight defaults to 1
+func parseWeighted(s string) sizeGen {
+	var (
+		gens    []sizeGen
+		weights []int64
+		total   int64
+	)
+	for _, choice := range strings.Split(s, ";") {
+		size, weightStr, found := strings.Cut(choice, ":")
+		weight := int64(1)
+		if found {
+			w, err := strconv.ParseInt(weightStr, 10, 64)
+			if err != nil || w <= 0 {
+				return nil
+			}
+			weight = w
+		}
+		gen := parseUniform(size)
+		if gen == nil {
+			return nil
+		}
+		gens = append(gens, gen)
+		weights = append(weights, weight)
+		total += weight
+	}
+	if len(gens) == 0 {
+		return nil
+	}
+	return func() int {
+		n := randInt64(total)
+		for i, w := range weights {
+			if n < w {
+				return gens[i]()
+			}
+			n -= w
+		}
+		return gens[len(gens)-1]()
+	}
+}
+
+// parseNormal parses "mean;stddev" with an optional "min-max" clamp
+func parseNormal(s string) sizeGen {
+	parts := strings.Split(s, ";")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil
+	}
+	mean, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || mean <= 0 {
+		return nil
+	}
+	stddev, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || stddev < 0 {
+		return nil
+	}
+	lo, hi := 1.0, float64(maxRecordSize)
+	if len(parts) == 3 {
+		a, b, found := strings.Cut(parts[2], "-")
+		if !found {
+			return nil
+		}
+		x, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return nil
+		}
+		y, err := strconv.ParseInt(b, 10, 64)
+		if err != nil {
+			return nil
+		}
+		if min(x, y) <= 0 {
+			return nil
+		}
+		lo, hi = float64(min(x, y)), float64(max(x, y))
+	}
+	return func() int {
+		v := math.Round(mrand.NormFloat64()*stddev + mean)
+		return int(min(max(v, lo), hi))
+	}
+}
+
+func randInt64(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	i, _ := rand.Int(rand.Reader, big.NewInt(n))
+	return i.Int64()
+}
+
+// ruleIndex maps a packet number to the rule that applies to it
+func (r *rulesV2) ruleIndex(pkt, stop uint32) (uint32, bool) {
+	if pkt < stop {
+		return pkt, true
+	}
+	if r.repeat {
+		return r.repeatFrom + (pkt-stop)%(r.repeatTo-r.repeatFrom+1), true
+	}
+	return 0, false
+}
+
+func (r *rulesV2) recordSizes(pkt, stop uint32) (pktSizes []int) {
+	idx, ok := r.ruleIndex(pkt, stop)
+	if !ok {
+		return nil
+	}
+	for _, gen := range r.sizes[idx] {
+		pktSizes = append(pktSizes, gen())
+	}
+	return
+}
+
+func (r *rulesV2) recordDelay(pkt, stop uint32) time.Duration {
+	if pkt >= stop {
+		// the session holds its writes while waiting, repeating would stall it for good
+		return 0
+	}
+	d, ok := r.delays[pkt]
+	if !ok || d.max == 0 {
+		return 0
+	}
+	if d.min == d.max {
+		return d.min
+	}
+	return d.min + time.Duration(randInt64(int64(d.max-d.min)))
+}
@@ -0,0 +1,194 @@
+package padding
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseV2(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		ok     bool
+		stop   uint32
+	}{
+		{"minimal", "version=2\nstop=3", true, 3},
+		{"no stop", "version=2\n0=30", false, 0},
+		{"invalid stop", "version=2\nstop=-1", false, 0},
+		{"bad lines are ignored", "version=2\nstop=2\n0=abc\nx=1\n1=10,zz,20", true, 2},
+		{"up overrides stop", "version=2\nstop=2\nup.stop=5", true, 5},
+		{"down without stop uses base", "version=2\nstop=2\ndown.0=100", true, 2},
+		{"invalid down stop", "version=2\nstop=2\ndown.stop=x", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPaddingFactory([]byte(tt.scheme))
+			if (p != nil) != tt.ok {
+				t.Fatalf("NewPaddingFactory() = %v, want ok %v", p, tt.ok)
+			}
+			if p == nil {
+				return
+			}
+			if p.Version != 2 {
+				t.Errorf("Version = %d, want 2", p.Version)
+			}
+			if p.Stop != tt.stop {
+				t.Errorf("Stop = %d, want %d", p.Stop, tt.stop)
+			}
+		})
+	}
+}
+
+func TestSizeTokens(t *testing.T) {
+	tests := []struct {
+		token    string
+		ok       bool
+		min, max int
+	}{
+		{"9", true, 9, 9},
+		{"100-200", true, 100, 200},
+		{"200-100", true, 100, 200},
+		{"c", true, CheckMark, CheckMark},
+		{"0", false, 0, 0},
+		{"-5", false, 0, 0},
+		{"a-b", false, 0, 0},
+		{"w(10:1;20-30:3)", true, 10, 30},
+		{"w(10;20)", true, 10, 20},
+		{"w(10:0)", false, 0, 0},
+		{"w(10:x)", false, 0, 0},
+		{"w()", false, 0, 0},
+		{"n(500;100)", true, 1, maxRecordSize},
+		{"n(500;100;400-600)", true, 400, 600},
+		{"n(500;0)", true, 500, 500},
+		{"n(500)", false, 0, 0},
+		{"n(-1;10)", false, 0, 0},
+		{"n(500;-1)", false, 0, 0},
+		{"n(500;10;0-100)", false, 0, 0},
+	}
+	for _, tt := range tests {
+		gen := parseSizeToken(tt.token)
+		if (gen != nil) != tt.ok {
+			t.Errorf("parseSizeToken(%q) ok = %v, want %v", tt.token, gen != nil, tt.ok)
+			continue
+		}
+		if gen == nil {
+			continue
+		}
+		for range 100 {
+			if n := gen(); n < tt.min || n > tt.max {
+				t.Errorf("parseSizeToken(%q) generated %d, want %d-%d", tt.token, n, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestParseDelay(t *testing.T) {
+	tests := []struct {
+		s        string
+		ok       bool
+		min, max time.Duration
+	}{
+		{"10ms", true, 10 * time.Millisecond, 10 * time.Millisecond},
+		{"5ms-20ms", true, 5 * time.Millisecond, 20 * time.Millisecond},
+		{"20ms-5ms", true, 5 * time.Millisecond, 20 * time.Millisecond},
+		{"1s", true, time.Second, time.Second},
+		{"2s", false, 0, 0},
+		{"-1ms", false, 0, 0},
+		{"10", false, 0, 0},
+		{"", false, 0, 0},
+	}
+	for _, tt := range tests {
+		d, ok := parseDelay(tt.s)
+		if ok != tt.ok || d.min != tt.min || d.max != tt.max {
+			t.Errorf("parseDelay(%q) = %v-%v %v, want %v-%v %v", tt.s, d.min, d.max, ok, tt.min, tt.max, tt.ok)
+		}
+	}
+}
+
+func TestDirections(t *testing.T) {
+	p := NewPaddingFactory([]byte(strings.Join([]string{
+		"version=2",
+		"stop=3",
+		"0=10",
+		"1=20",
+		"up.1=21",
+		"down.stop=2",
+		"down.0=30",
+		"delay.1=7ms",
+		"down.delay.1=0s",
+	}, "\n")))
+	if p == nil {
+		t.Fatal("scheme does not parse")
+	}
+	if !p.HasDirection(Downstream) {
+		t.Fatal("scheme with down. keys has no downstream rules")
+	}
+	up, down := p.ForDirection(Upstream), p.ForDirection(Downstream)
+	if up.Stop != 3 || down.Stop != 2 {
+		t.Errorf("stop = %d/%d, want 3/2", up.Stop, down.Stop)
+	}
+
+	tests := []struct {
+		name  string
+		p     *PaddingFactory
+		pkt   uint32
+		size  int
+		delay time.Duration
+	}{
+		{"up unprefixed", up, 0, 10, 0},
+		{"up prefixed", up, 1, 21, 7 * time.Millisecond},
+		{"down prefixed", down, 0, 30, 0},
+		{"down unprefixed", down, 1, 20, 0},
+		{"down after stop", down, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		sizes := tt.p.GenerateRecordPayloadSizes(tt.pkt)
+		var size int
+		if len(sizes) > 0 {
+			size = sizes[0]
+		}
+		if size != tt.size {
+			t.Errorf("%s: size %d, want %d", tt.name, size, tt.size)
+		}
+		if d := tt.p.RecordDelay(tt.pkt); d != tt.delay {
+			t.Errorf("%s: delay %v, want %v", tt.name, d, tt.delay)
+		}
+	}
+
+	legacy := NewPaddingFactory([]byte("stop=2\n0=10-10"))
+	if legacy.HasDirection(Downstream) || legacy.ForDirection(Downstream) != legacy {
+		t.Error("legacy scheme has downstream rules")
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	p := NewPaddingFactory([]byte("version=2\nstop=3\n0=10\n1=20\n2=30\ndelay.1=7ms\nrepeat=1-2"))
+	if p == nil {
+		t.Fatal("scheme does not parse")
+	}
+	want := []int{10, 20, 30, 20, 30, 20}
+	for pkt, size := range want {
+		if !p.Active(uint32(pkt)) {
+			t.Fatalf("packet %d is not active", pkt)
+		}
+		if got := p.GenerateRecordPayloadSizes(uint32(pkt)); len(got) != 1 || got[0] != size {
+			t.Errorf("packet %d: sizes %v, want [%d]", pkt, got, size)
+		}
+	}
+	if d := p.RecordDelay(1); d != 7*time.Millisecond {
+		t.Errorf("packet 1: delay %v, want 7ms", d)
+	}
+	if d := p.RecordDelay(3); d != 0 {
+		t.Errorf("repeated packet 3: delay %v, want none", d)
+	}
+	if issues := Lint([]byte("version=2\nstop=3\n0=10\n1=20\n2=30\ndelay.2=7ms\ndelay.3=7ms\nrepeat=1-2")); len(issues) != 1 || issues[0].Line != 7 {
+		t.Errorf("Lint of a delay after stop: %v, want one issue on line 7", issues)
+	}
+
+	noRepeat := NewPaddingFactory([]byte("version=2\nstop=3\n0=10\nrepeat=x"))
+	if noRepeat.Active(3) {
+		t.Error("packet after stop is active without a valid repeat")
+	}
+}
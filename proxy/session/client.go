@@ -38,18 +38,33 @@ type Client struct {
 
 	idleSessionTimeout time.Duration
 	minIdleSession     int
+
+	healthHook func(err error)
+
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
 }
 
+// idleProbeAfter is how long a pooled session may stay silent before it is
+// probed with cmdHeartRequest on its way out of the pool
+const idleProbeAfter = 5 * time.Second
+
 func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 	_padding *atomic.TypedValue[*padding.PaddingFactory], idleSessionCheckInterval, idleSessionTimeout time.Duration, minIdleSession int,
 ) *Client {
 	c := &Client{
 		sessions:           make(map[uint64]*Session),
 		dialOut:            dialOut,
-		padding:            _padding,
+		padding:            new(atomic.TypedValue[*padding.PaddingFactory]),
 		idleSessionTimeout: idleSessionTimeout,
 		minIdleSession:     minIdleSession,
 	}
+	// The scheme pushed by a server only applies to the Client connected to it,
+	// so each Client starts from a copy of the initial scheme.
+	if _padding == nil {
+		_padding = &padding.DefaultPaddingFactory
+	}
+	c.padding.Store(_padding.Load())
 	if idleSessionCheckInterval <= time.Second*5 {
 		idleSessionCheckInterval = time.Second * 30
 	}
@@ -101,7 +116,7 @@ func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
 
 	stream.dieHook = func() {
 		// If Session is not closed, put this Stream to pool
-		if !session.IsClosed() {
+		if !session.IsClosed() && !session.IsGoingAway() {
 			if clientDebugSessionPool {
 				logrus.Infoln("put session:", session.seq, stream.id)
 			}
@@ -125,25 +140,52 @@ func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
 	return stream, nil
 }
 
-func (c *Client) getIdleSession() (idle *Session) {
-	c.idleSessionLock.Lock()
-	if !c.idleSession.IsEmpty() {
-		it := c.idleSession.Iterate()
-		idle = it.Value()
-		c.idleSession.Remove(it.Key())
+func (c *Client) getIdleSession() *Session {
+	for {
+		var idle *Session
+		c.idleSessionLock.Lock()
+		if !c.idleSession.IsEmpty() {
+			it := c.idleSession.Iterate()
+			idle = it.Value()
+			c.idleSession.Remove(it.Key())
+		}
+		c.idleSessionLock.Unlock()
+
+		if idle == nil {
+			return nil
+		}
+		if idle.IsGoingAway() {
+			// The server is shutting down, this session will be closed once drained
+			continue
+		}
+		// A session silent for a while may have been dropped by a NAT on the way;
+		// make sure it still works before handing it out.
+		if c.heartbeatTimeout > 0 && idle.SilentFor() > idleProbeAfter {
+			if err := idle.Ping(c.heartbeatTimeout); err != nil {
+				if clientDebugSessionPool {
+					logrus.Infoln("discard dead idle session:", idle.seq, err)
+				}
+				idle.Close()
+				continue
+			}
+		}
+		return idle
 	}
-	c.idleSessionLock.Unlock()
-	return
 }
 
 func (c *Client) createSession(ctx context.Context) (*Session, error) {
 	underlying, err := c.dialOut(ctx)
 	if err != nil {
+		if c.healthHook != nil {
+			c.healthHook(err)
+		}
 		return nil, err
 	}
 
-	session := NewClientSession(underlying, &padding.DefaultPaddingFactory)
+	session := NewClientSession(underlying, c.padding)
 	session.seq = c.sessionCounter.Add(1)
+	session.onSynAck = c.healthHook
+	session.SetHeartbeat(c.heartbeatInterval, c.heartbeatTimeout)
 	session.dieHook = func() {
 		if clientDebugSessionPool {
 			logrus.Infoln("session died:", session.seq, session.streamId.Load(), session.pktCounter.Load())
@@ -166,6 +208,61 @@ func (c *Client) createSession(ctx context.Context) (*Session, error) {
 	return session, nil
 }
 
+// SetHealthHook sets a function that is told about every outcome that says something
+// about the server itself: failing to dial a new session and waiting for cmdSYNACK.
+// err is nil when cmdSYNACK arrived in time; a successful dial alone is not reported,
+// since a server that completes the TLS handshake may still not answer.
+// Errors reported inside cmdSYNACK concern the destination and are not passed
+// to the hook. It must be set before the first CreateStream.
+func (c *Client) SetHealthHook(hook func(err error)) {
+	c.healthHook = hook
+}
+
+// SetHeartbeat enables active keepalive on every session of this Client, see
+// Session.SetHeartbeat. With a non-zero timeout, pooled sessions that have been
+// silent for a while are also probed before they are reused.
+// It must be called before the first CreateStream.
+func (c *Client) SetHeartbeat(interval, timeout time.Duration) {
+	c.heartbeatInterval = interval
+	c.heartbeatTimeout = timeout
+}
+
+// PaddingFactory returns the padding scheme currently used by this Client,
+// which is replaced when the server sends cmdUpdatePaddingScheme
+func (c *Client) PaddingFactory() *padding.PaddingFactory {
+	return c.padding.Load()
+}
+
+// SessionCount returns the number of live sessions
+func (c *Client) SessionCount() int {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	return len(c.sessions)
+}
+
+// IdleSessionCount returns the number of sessions in the idle pool
+func (c *Client) IdleSessionCount() int {
+	c.idleSessionLock.Lock()
+	defer c.idleSessionLock.Unlock()
+	return c.idleSession.Len()
+}
+
+// StreamCount returns the number of open streams over all sessions
+func (c *Client) StreamCount() int {
+	c.sessionsLock.Lock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	c.sessionsLock.Unlock()
+
+	var count int
+	for _, session := range sessions {
+		count += session.StreamCount()
+	}
+	return count
+}
+
 func (c *Client) Close() error {
 	c.dieCancel()
 
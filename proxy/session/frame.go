@@ -2,6 +2,7 @@ package session
 
 import (
 	"encoding/binary"
+	"time"
 )
 
 const ( // cmds
@@ -17,6 +18,29 @@ const ( // cmds
 	cmdHeartRequest   = 8  // Keep alive command
 	cmdHeartResponse  = 9  // Keep alive command
 	cmdServerSettings = 10 // Settings (Server send to client)
+	// Extension, ignored by peers that do not know it
+	cmdGoAway = 11 // Server is shutting down, the client should not open new streams on this session
+	// Since version 3
+	cmdWindowUpdate = 12 // Grants the peer more send window on a stream
+)
+
+const (
+	// protocolVersion is the version sent in cmdSettings / cmdServerSettings
+	protocolVersion = 3
+	// defaultStreamWindow is the per-stream receive window, advertised as "window"
+	// in the settings; it is also assumed for v3 peers that do not advertise one
+	defaultStreamWindow = 2 * 1024 * 1024
+	// maxDataFrameSize is the largest payload a single cmdPSH can carry
+	maxDataFrameSize = 65535
+	// recvWindowSlack is how far past our window a peer may go before the stream
+	// is closed, a margin for peers whose window differs from the default
+	recvWindowSlack = 512 * 1024
+	// settingsTimeout is how long the client keeps to the default window while
+	// waiting for cmdServerSettings, which a v1 server never sends
+	settingsTimeout = 5 * time.Second
+	// maxPacketDelay bounds the padding delay of one packet, far below the
+	// write deadline of writeControlFrame
+	maxPacketDelay = time.Second
 )
 
 const (
@@ -0,0 +1,30 @@
+package session
+
+import (
+	"anytls/metrics"
+	"strings"
+)
+
+var (
+	metricSessionsCreated    = metrics.NewCounter("anytls_sessions_created_total", "Sessions created since start.")
+	metricStreamOpenFailures = metrics.NewCounterVec("anytls_stream_open_failures_total", "Streams that failed to open, by cmdSYNACK error.", "error")
+)
+
+// classifyStreamError maps a cmdSYNACK error text to a small set of label values,
+// the raw text contains addresses and would explode the label cardinality.
+func classifyStreamError(msg string) string {
+	switch {
+	case strings.Contains(msg, "connection refused"):
+		return "connection_refused"
+	case strings.Contains(msg, "connection reset"):
+		return "connection_reset"
+	case strings.Contains(msg, "timeout"):
+		return "timeout"
+	case strings.Contains(msg, "no such host"), strings.Contains(msg, "server misbehaving"):
+		return "dns"
+	case strings.Contains(msg, "unreachable"), strings.Contains(msg, "no route to host"):
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
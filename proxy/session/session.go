@@ -5,6 +5,7 @@ import (
 	"anytls/util"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -22,6 +23,15 @@ import (
 
 var clientDebugPaddingScheme = os.Getenv("CLIENT_DEBUG_PADDING_SCHEME") == "1"
 
+// ErrSynAckTimeout is reported when the server does not answer cmdSYN in time
+var ErrSynAckTimeout = errors.New("cmdSYNACK timeout")
+
+// ErrWindowExceeded closes a stream whose peer sent more than the receive window allows
+var ErrWindowExceeded = errors.New("peer exceeded the stream receive window")
+
+// ErrHeartbeatTimeout is returned by Ping when the peer does not answer cmdHeartRequest in time
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
 type Session struct {
 	conn     net.Conn
 	connLock sync.Mutex
@@ -36,6 +46,10 @@ type Session struct {
 
 	synDone     func()
 	synDoneLock sync.Mutex
+	// onSynAck is told whether the server answered cmdSYN in time (client only)
+	onSynAck func(err error)
+	// synAckSeen is set by recvLoop once any cmdSYNACK arrived
+	synAckSeen bool
 
 	// pool
 	seq       uint64
@@ -44,15 +58,37 @@ type Session struct {
 
 	peerVersion byte
 
+	// flow control, used when both sides speak protocol v3
+	recvWindow int          // our per-stream receive window
+	peerWindow atomic.Int64 // the peer's per-stream receive window
+	// settled is closed once the client knows the server's version (client only)
+	settled    chan struct{}
+	settleOnce sync.Once
+
+	// heartbeat
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	lastRecv          atomic.Int64 // unix nano of the last frame received
+	heartResponse     chan struct{}
+	pingLock          sync.Mutex
+
+	// goAway is set once cmdGoAway has been sent (server) or received (client);
+	// the session is closed as soon as its last stream is gone
+	goAway atomic.Bool
+
 	// client
 	isClient    bool
 	sendPadding bool
 	buffering   bool
 	buffer      []byte
 	pktCounter  atomic.Uint32
+	// sleep replaces time.Sleep for packet delays when set, see SimulateWrites
+	sleep func(d time.Duration)
 
 	// server
 	onNewStream func(stream *Stream)
+	// downstreamPadding is the scheme the server pads its own writes with
+	downstreamPadding *atomic.TypedValue[*padding.PaddingFactory]
 }
 
 func NewClientSession(conn net.Conn, _padding *atomic.TypedValue[*padding.PaddingFactory]) *Session {
@@ -61,9 +97,15 @@ func NewClientSession(conn net.Conn, _padding *atomic.TypedValue[*padding.Paddin
 		isClient:    true,
 		sendPadding: true,
 		padding:     _padding,
+		settled:     make(chan struct{}),
 	}
+	s.recvWindow = defaultStreamWindow
+	s.peerWindow.Store(defaultStreamWindow)
+	s.heartResponse = make(chan struct{}, 1)
+	s.lastRecv.Store(time.Now().UnixNano())
 	s.die = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	metricSessionsCreated.Inc()
 	return s
 }
 
@@ -73,21 +115,50 @@ func NewServerSession(conn net.Conn, onNewStream func(stream *Stream), _padding
 		onNewStream: onNewStream,
 		padding:     _padding,
 	}
+	s.recvWindow = defaultStreamWindow
+	s.peerWindow.Store(defaultStreamWindow)
+	s.heartResponse = make(chan struct{}, 1)
+	s.lastRecv.Store(time.Now().UnixNano())
 	s.die = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	metricSessionsCreated.Inc()
 	return s
 }
 
+// SetHeartbeat enables active keepalive: when nothing has been received for interval,
+// cmdHeartRequest is sent and the session is closed unless cmdHeartResponse arrives
+// within timeout. Peers older than protocol version 2 are never probed.
+// It must be called before Run.
+func (s *Session) SetHeartbeat(interval, timeout time.Duration) {
+	s.heartbeatInterval = interval
+	s.heartbeatTimeout = timeout
+}
+
+// SetDownstreamPadding makes the server pad the traffic it sends with the given
+// scheme, counting its first write as packet 0. It must be called before Run.
+func (s *Session) SetDownstreamPadding(_padding *atomic.TypedValue[*padding.PaddingFactory]) {
+	if s.isClient || _padding == nil || _padding.Load() == nil {
+		return
+	}
+	s.downstreamPadding = _padding
+	s.sendPadding = true
+}
+
 func (s *Session) Run() {
+	if s.heartbeatInterval > 0 {
+		go s.heartbeatLoop()
+	}
+
 	if !s.isClient {
 		s.recvLoop()
 		return
 	}
 
 	settings := util.StringMap{
-		"v":           "2",
+		"v":           strconv.Itoa(protocolVersion),
 		"client":      util.ProgramVersionName,
 		"padding-md5": s.padding.Load().Md5,
+		"window":      strconv.Itoa(s.recvWindow),
 	}
 	f := newFrame(cmdSettings, 0)
 	f.data = settings.ToBytes()
@@ -97,6 +168,117 @@ func (s *Session) Run() {
 	go s.recvLoop()
 }
 
+// StreamCount returns the number of open streams
+func (s *Session) StreamCount() int {
+	s.streamLock.RLock()
+	defer s.streamLock.RUnlock()
+	return len(s.streams)
+}
+
+// Ping sends cmdHeartRequest and waits for cmdHeartResponse.
+// The session is closed if no response arrives within timeout.
+func (s *Session) Ping(timeout time.Duration) error {
+	if s.peerVersion < 2 {
+		// cmdHeartRequest is only defined since version 2
+		return nil
+	}
+
+	s.pingLock.Lock()
+	defer s.pingLock.Unlock()
+
+	// discard a late response to an earlier request
+	select {
+	case <-s.heartResponse:
+	default:
+	}
+	if _, err := s.writeControlFrame(newFrame(cmdHeartRequest, 0)); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.heartResponse:
+		return nil
+	case <-s.die:
+		return io.ErrClosedPipe
+	case <-timer.C:
+		s.Close()
+		return ErrHeartbeatTimeout
+	}
+}
+
+// SilentFor returns how long nothing has been received from the peer
+func (s *Session) SilentFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastRecv.Load()))
+}
+
+func (s *Session) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+		}
+		if s.SilentFor() < s.heartbeatInterval {
+			continue
+		}
+		if err := s.Ping(s.heartbeatTimeout); err != nil {
+			logrus.Debugln("[Heartbeat]", s.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// flowControl reports whether per-stream flow control is in effect,
+// which requires both sides to speak protocol v3
+func (s *Session) flowControl() bool {
+	return s.peerVersion >= 3
+}
+
+// sendLimited reports whether stream writes must stay within the peer's window.
+// A v3 server enforces its window from the first byte, so until cmdServerSettings
+// tells otherwise the client assumes the default window.
+func (s *Session) sendLimited() bool {
+	// peerVersion is only read once settled, recvLoop sets it before
+	return s.settling() != nil || s.flowControl()
+}
+
+// settling returns a channel closed once the client knows the server's version,
+// or nil if it is already known
+func (s *Session) settling() <-chan struct{} {
+	if !s.isClient {
+		return nil
+	}
+	select {
+	case <-s.settled:
+		return nil
+	default:
+		return s.settled
+	}
+}
+
+// settle records that the server's version is known, or that it is not coming
+func (s *Session) settle() {
+	s.settleOnce.Do(func() { close(s.settled) })
+}
+
+// applyPeerWindow reads the peer's per-stream receive window from its settings
+func (s *Session) applyPeerWindow(m util.StringMap) {
+	if window, err := strconv.Atoi(m["window"]); err == nil && window > 0 {
+		s.peerWindow.Store(int64(window))
+	}
+}
+
+func (s *Session) writeWindowUpdate(sid uint32, n uint32) error {
+	f := newFrame(cmdWindowUpdate, sid)
+	f.data = binary.BigEndian.AppendUint32(nil, n)
+	_, err := s.writeControlFrame(f)
+	return err
+}
+
 // IsClosed does a safe check to see if we have shutdown
 func (s *Session) IsClosed() bool {
 	select {
@@ -131,9 +313,41 @@ func (s *Session) Close() error {
 	}
 }
 
+// Alert sends cmdAlert with the message to the peer, then closes the session.
+func (s *Session) Alert(message string) error {
+	f := newFrame(cmdAlert, 0)
+	f.data = []byte(message)
+	_, err := s.writeControlFrame(f)
+	s.Close()
+	return err
+}
+
+// GoAway sends cmdGoAway to the peer so that it stops opening new streams on this session.
+// Existing streams keep running, the session is closed once the last one is gone.
+func (s *Session) GoAway() error {
+	if s.goAway.Swap(true) {
+		return nil
+	}
+	_, err := s.writeControlFrame(newFrame(cmdGoAway, 0))
+	s.closeIfDrained()
+	return err
+}
+
+// IsGoingAway reports whether cmdGoAway has been sent or received on this session
+func (s *Session) IsGoingAway() bool {
+	return s.goAway.Load()
+}
+
+// closeIfDrained closes a going-away session that has no streams left
+func (s *Session) closeIfDrained() {
+	if s.goAway.Load() && s.StreamCount() == 0 {
+		s.Close()
+	}
+}
+
 // OpenStream is used to create a new stream for CLIENT
 func (s *Session) OpenStream() (*Stream, error) {
-	if s.IsClosed() {
+	if s.IsClosed() || s.goAway.Load() {
 		return nil, io.ErrClosedPipe
 	}
 
@@ -142,32 +356,33 @@ func (s *Session) OpenStream() (*Stream, error) {
 
 	//logrus.Debugln("stream open", sid, s.streams)
 
+	// the first stream is sent before the server version is known, its
+	// watcher is started by cmdServerSettings, see recvLoop
 	if sid >= 2 && s.peerVersion >= 2 {
-		s.synDoneLock.Lock()
-		if s.synDone != nil {
-			s.synDone()
-		}
-		s.synDone = util.NewDeadlineWatcher(time.Second*3, func() {
-			s.Close()
-		})
-		s.synDoneLock.Unlock()
+		s.watchSynAck()
 	}
 
-	if _, err := s.writeControlFrame(newFrame(cmdSYN, sid)); err != nil {
-		return nil, err
-	}
-
-	s.buffering = false // proxy Write it's SocksAddr to flush the buffer
-
+	// registered before cmdSYN is sent, the server may answer right away
 	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
 	select {
 	case <-s.die:
+		s.streamLock.Unlock()
 		return nil, io.ErrClosedPipe
 	default:
 		s.streams[sid] = stream
-		return stream, nil
 	}
+	s.streamLock.Unlock()
+
+	if _, err := s.writeControlFrame(newFrame(cmdSYN, sid)); err != nil {
+		s.streamLock.Lock()
+		delete(s.streams, sid)
+		s.streamLock.Unlock()
+		return nil, err
+	}
+
+	s.buffering = false // proxy Write it's SocksAddr to flush the buffer
+
+	return stream, nil
 }
 
 func (s *Session) recvLoop() error {
@@ -187,7 +402,16 @@ func (s *Session) recvLoop() error {
 		}
 		// read header first
 		if _, err := io.ReadFull(s.conn, hdr[:]); err == nil {
+			s.lastRecv.Store(time.Now().UnixNano())
 			sid := hdr.StreamID()
+			if s.isClient {
+				switch hdr.Cmd() {
+				case cmdWaste, cmdUpdatePaddingScheme, cmdServerSettings:
+				default:
+					// a v2+ server answers cmdSettings before anything else, this is v1
+					s.settle()
+				}
+			}
 			switch hdr.Cmd() {
 			case cmdPSH:
 				if hdr.Length() > 0 {
@@ -196,10 +420,15 @@ func (s *Session) recvLoop() error {
 						s.streamLock.RLock()
 						stream, ok := s.streams[sid]
 						s.streamLock.RUnlock()
-						if ok {
-							stream.pipeW.Write(buffer)
+						if ok && s.flowControl() {
+							// the peer respects our window, queue without blocking other streams
+							stream.pushData(buffer)
+						} else {
+							if ok {
+								stream.pipeW.Write(buffer)
+							}
+							buf.Put(buffer)
 						}
-						buf.Put(buffer)
 					} else {
 						buf.Put(buffer)
 						return err
@@ -226,10 +455,14 @@ func (s *Session) recvLoop() error {
 				}
 				s.streamLock.Unlock()
 			case cmdSYNACK: // should be client only
+				s.synAckSeen = true
 				s.synDoneLock.Lock()
 				if s.synDone != nil {
 					s.synDone()
 					s.synDone = nil
+					if s.onSynAck != nil {
+						s.onSynAck(nil)
+					}
 				}
 				s.synDoneLock.Unlock()
 				if hdr.Length() > 0 {
@@ -239,6 +472,7 @@ func (s *Session) recvLoop() error {
 						return err
 					}
 					// report error
+					metricStreamOpenFailures.Inc(classifyStreamError(string(buffer)))
 					s.streamLock.RLock()
 					stream, ok := s.streams[sid]
 					s.streamLock.RUnlock()
@@ -253,9 +487,10 @@ func (s *Session) recvLoop() error {
 				delete(s.streams, sid)
 				s.streamLock.Unlock()
 				if ok {
-					stream.closeLocally()
+					stream.finReceived()
 				}
 				//logrus.Debugln("stream fin", sid, s.streams)
+				s.closeIfDrained()
 			case cmdWaste:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
@@ -289,11 +524,17 @@ func (s *Session) recvLoop() error {
 						// check client's version
 						if v, err := strconv.Atoi(m["v"]); err == nil && v >= 2 {
 							s.peerVersion = byte(v)
+							s.applyPeerWindow(m)
 							// send cmdServerSettings
 							f := newFrame(cmdServerSettings, 0)
-							f.data = util.StringMap{
-								"v": "2",
-							}.ToBytes()
+							settings := util.StringMap{
+								"v":      strconv.Itoa(protocolVersion),
+								"window": strconv.Itoa(s.recvWindow),
+							}
+							if s.downstreamPadding != nil {
+								settings["downstream-padding-md5"] = s.sendPaddingFactory().Md5
+							}
+							f.data = settings.ToBytes()
 							_, err = s.writeControlFrame(f)
 							if err != nil {
 								buf.Put(buffer)
@@ -324,7 +565,9 @@ func (s *Session) recvLoop() error {
 						return err
 					}
 					if s.isClient && !clientDebugPaddingScheme {
-						if padding.UpdatePaddingScheme(rawScheme) {
+						// s.padding is owned by the Client this session belongs to
+						if p := padding.NewPaddingFactory(rawScheme); p != nil {
+							s.padding.Store(p)
 							logrus.Infof("[Update padding succeed] %x\n", md5.Sum(rawScheme))
 						} else {
 							logrus.Warnf("[Update padding failed] %x\n", md5.Sum(rawScheme))
@@ -336,8 +579,33 @@ func (s *Session) recvLoop() error {
 					return err
 				}
 			case cmdHeartResponse:
-				// Active keepalive checking is not implemented yet
-				break
+				select {
+				case s.heartResponse <- struct{}{}:
+				default:
+				}
+			case cmdWindowUpdate:
+				if hdr.Length() > 0 {
+					buffer := buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+						buf.Put(buffer)
+						return err
+					}
+					if len(buffer) >= 4 {
+						s.streamLock.RLock()
+						stream, ok := s.streams[sid]
+						s.streamLock.RUnlock()
+						if ok {
+							stream.windowUpdate(binary.BigEndian.Uint32(buffer))
+						}
+					}
+					buf.Put(buffer)
+				}
+			case cmdGoAway:
+				if s.isClient {
+					logrus.Debugln("[GoAway from server]", s.seq)
+					s.goAway.Store(true)
+					s.closeIfDrained()
+				}
 			case cmdServerSettings:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
@@ -351,6 +619,19 @@ func (s *Session) recvLoop() error {
 						if v, err := strconv.Atoi(m["v"]); err == nil {
 							s.peerVersion = byte(v)
 						}
+						// only now is it known that the first stream gets a cmdSYNACK
+						if s.peerVersion >= 2 && s.streamId.Load() == 1 && !s.synAckSeen {
+							s.watchSynAck()
+						}
+						s.applyPeerWindow(m)
+						if md5 := m["downstream-padding-md5"]; md5 != "" {
+							if md5 != s.padding.Load().Md5 && md5 != padding.DefaultDownstreamPaddingFactory.Load().Md5 {
+								logrus.Warnln("[Downstream padding] the server pads its traffic with a scheme this client does not know:", md5)
+							} else {
+								logrus.Debugln("[Downstream padding]", md5)
+							}
+						}
+						s.settle()
 					}
 					buf.Put(buffer)
 				}
@@ -363,6 +644,23 @@ func (s *Session) recvLoop() error {
 	}
 }
 
+// watchSynAck closes the session if the last opened stream is not answered
+// with cmdSYNACK in time, replacing the watcher of the previous stream
+func (s *Session) watchSynAck() {
+	s.synDoneLock.Lock()
+	if s.synDone != nil {
+		s.synDone()
+	}
+	s.synDone = util.NewDeadlineWatcher(time.Second*3, func() {
+		metricStreamOpenFailures.Inc("synack_timeout")
+		if s.onSynAck != nil {
+			s.onSynAck(ErrSynAckTimeout)
+		}
+		s.Close()
+	})
+	s.synDoneLock.Unlock()
+}
+
 func (s *Session) streamClosed(sid uint32) error {
 	if s.IsClosed() {
 		return io.ErrClosedPipe
@@ -371,6 +669,7 @@ func (s *Session) streamClosed(sid uint32) error {
 	s.streamLock.Lock()
 	delete(s.streams, sid)
 	s.streamLock.Unlock()
+	s.closeIfDrained()
 	return err
 }
 
@@ -414,79 +713,137 @@ func (s *Session) writeControlFrame(frame frame) (int, error) {
 	return dataLen, nil
 }
 
+// sendPaddingFactory returns the rules this side pads its writes with. The server
+// prefers the "down." rules of the scheme negotiated with the client over the
+// separate downstream scheme.
+func (s *Session) sendPaddingFactory() *padding.PaddingFactory {
+	if s.isClient {
+		return s.padding.Load()
+	}
+	if p := s.padding.Load(); p.HasDirection(padding.Downstream) {
+		return p.ForDirection(padding.Downstream)
+	}
+	return s.downstreamPadding.Load().ForDirection(padding.Downstream)
+}
+
 func (s *Session) writeConn(b []byte) (n int, err error) {
 	s.connLock.Lock()
-	defer s.connLock.Unlock()
-
 	if s.buffering {
 		s.buffer = slices.Concat(s.buffer, b)
+		s.connLock.Unlock()
 		return len(b), nil
-	} else if len(s.buffer) > 0 {
-		b = slices.Concat(s.buffer, b)
-		s.buffer = nil
 	}
 
-	// calulate & send padding
+	var (
+		padded   bool
+		pktSizes []int
+		delay    time.Duration
+	)
 	if s.sendPadding {
 		pkt := s.pktCounter.Add(1)
-		paddingF := s.padding.Load()
-		if pkt < paddingF.Stop {
-			pktSizes := paddingF.GenerateRecordPayloadSizes(pkt)
-			for _, l := range pktSizes {
-				remainPayloadLen := len(b)
-				if l == padding.CheckMark {
-					if remainPayloadLen == 0 {
-						break
-					} else {
-						continue
-					}
+		if !s.isClient {
+			// the server has no authentication packet, its first write is packet 0
+			pkt--
+		}
+		paddingF := s.sendPaddingFactory()
+		if paddingF.Active(pkt) {
+			padded = true
+			pktSizes = paddingF.GenerateRecordPayloadSizes(pkt)
+			delay = packetDelay(paddingF, pkt, pktSizes, len(s.buffer)+len(b))
+		} else {
+			s.sendPadding = false
+		}
+	}
+	defer s.connLock.Unlock()
+	if delay > 0 {
+		// the lock is kept so that later frames, a cmdFIN included, queue behind this packet
+		if s.sleep != nil {
+			s.sleep(delay)
+		} else {
+			time.Sleep(delay)
+		}
+	}
+
+	// whoever writes first after buffering ends flushes the buffer
+	if len(s.buffer) > 0 {
+		b = slices.Concat(s.buffer, b)
+		s.buffer = nil
+		if s.isClient {
+			// cmdSettings is on its way; a v1 server never answers it
+			time.AfterFunc(settingsTimeout, s.settle)
+		}
+	}
+
+	// send padding
+	if padded {
+		for _, l := range pktSizes {
+			remainPayloadLen := len(b)
+			if l == padding.CheckMark {
+				if remainPayloadLen == 0 {
+					break
+				} else {
+					continue
 				}
-				// logrus.Debugln(pkt, "write", l, "len", remainPayloadLen, "remain", remainPayloadLen-l)
-				if remainPayloadLen > l { // this packet is all payload
-					_, err = s.conn.Write(b[:l])
-					if err != nil {
-						return 0, err
-					}
-					n += l
-					b = b[l:]
-				} else if remainPayloadLen > 0 { // this packet contains padding and the last part of payload
-					paddingLen := l - remainPayloadLen - headerOverHeadSize
-					if paddingLen > 0 {
-						padding := make([]byte, headerOverHeadSize+paddingLen)
-						padding[0] = cmdWaste
-						binary.BigEndian.PutUint32(padding[1:5], 0)
-						binary.BigEndian.PutUint16(padding[5:7], uint16(paddingLen))
-						b = slices.Concat(b, padding)
-					}
-					_, err = s.conn.Write(b)
-					if err != nil {
-						return 0, err
-					}
-					n += remainPayloadLen
-					b = nil
-				} else { // this packet is all padding
-					padding := make([]byte, headerOverHeadSize+l)
+			}
+			// logrus.Debugln(pkt, "write", l, "len", remainPayloadLen, "remain", remainPayloadLen-l)
+			if remainPayloadLen > l { // this packet is all payload
+				_, err = s.conn.Write(b[:l])
+				if err != nil {
+					return 0, err
+				}
+				n += l
+				b = b[l:]
+			} else if remainPayloadLen > 0 { // this packet contains padding and the last part of payload
+				paddingLen := l - remainPayloadLen - headerOverHeadSize
+				if paddingLen > 0 {
+					padding := make([]byte, headerOverHeadSize+paddingLen)
 					padding[0] = cmdWaste
 					binary.BigEndian.PutUint32(padding[1:5], 0)
-					binary.BigEndian.PutUint16(padding[5:7], uint16(l))
-					_, err = s.conn.Write(padding)
-					if err != nil {
-						return 0, err
-					}
-					b = nil
+					binary.BigEndian.PutUint16(padding[5:7], uint16(paddingLen))
+					b = slices.Concat(b, padding)
 				}
+				_, err = s.conn.Write(b)
+				if err != nil {
+					return 0, err
+				}
+				n += remainPayloadLen
+				b = nil
+			} else { // this packet is all padding
+				padding := make([]byte, headerOverHeadSize+l)
+				padding[0] = cmdWaste
+				binary.BigEndian.PutUint32(padding[1:5], 0)
+				binary.BigEndian.PutUint16(padding[5:7], uint16(l))
+				_, err = s.conn.Write(padding)
+				if err != nil {
+					return 0, err
+				}
+				b = nil
 			}
-			// maybe still remain payload to write
-			if len(b) == 0 {
-				return
-			} else {
-				n2, err := s.conn.Write(b)
-				return n + n2, err
-			}
+		}
+		// maybe still remain payload to write
+		if len(b) == 0 {
+			return
 		} else {
-			s.sendPadding = false
+			n2, err := s.conn.Write(b)
+			return n + n2, err
 		}
 	}
 
 	return s.conn.Write(b)
 }
+
+// packetDelay returns how long to wait before writing packet pkt of size bytes:
+// the delay of every record it is split into, at most maxPacketDelay
+func packetDelay(p *padding.PaddingFactory, pkt uint32, pktSizes []int, size int) (delay time.Duration) {
+	for _, l := range pktSizes {
+		if l == padding.CheckMark {
+			if size == 0 {
+				break
+			}
+			continue
+		}
+		delay += p.RecordDelay(pkt)
+		size = max(size-l, 0)
+	}
+	return min(delay, maxPacketDelay)
+}
@@ -0,0 +1,326 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"anytls/util"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+)
+
+// newLoopback runs a client and a server session over net.Pipe.
+// Every stream the server accepts is acknowledged and passed to handle.
+// Like the destination address in the real client, something must be written
+// on a new stream to flush cmdSYN, see openStream.
+func newLoopback(t *testing.T, handle func(stream *Stream)) *Session {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	server := NewServerSession(serverConn, func(stream *Stream) {
+		stream.HandshakeSuccess()
+		handle(stream)
+	}, &padding.DefaultPaddingFactory)
+	go server.Run()
+	client := NewClientSession(clientConn, &padding.DefaultPaddingFactory)
+	client.Run()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func openStream(t *testing.T, client *Session) *Stream {
+	t.Helper()
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// TestSlowReaderWindow checks that a stream nobody reads holds at most one
+// window of data and does not block the other streams of the session.
+func TestSlowReaderWindow(t *testing.T) {
+	const total = 4 * defaultStreamWindow
+	payload := make([]byte, total)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	written := make(chan int, 1)
+	var slowServer *Stream
+	serverStream := make(chan *Stream, 1)
+	client := newLoopback(t, func(stream *Stream) {
+		if stream.id == 1 {
+			serverStream <- stream
+			n, _ := stream.Write(payload)
+			written <- n
+			return
+		}
+		stream.Write([]byte("pong"))
+	})
+
+	slow := openStream(t, client)
+	slowServer = <-serverStream
+	time.Sleep(500 * time.Millisecond)
+
+	if !client.flowControl() {
+		t.Fatal("flow control is not in effect between two v3 sessions")
+	}
+	if unacked := slowServer.sendUnacked.Load(); unacked > defaultStreamWindow {
+		t.Errorf("sender has %d bytes in flight, window is %d", unacked, defaultStreamWindow)
+	}
+	slow.recvLock.Lock()
+	outstanding := slow.recvOutstanding
+	slow.recvLock.Unlock()
+	if outstanding > defaultStreamWindow {
+		t.Errorf("receiver holds %d bytes, window is %d", outstanding, defaultStreamWindow)
+	}
+	select {
+	case n := <-written:
+		t.Fatalf("all %d bytes were written although nothing was read", n)
+	default:
+	}
+
+	// another stream of the same session is not held up by the slow one
+	fast := openStream(t, client)
+	fast.SetReadDeadline(time.Now().Add(3 * time.Second))
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(fast, pong); err != nil || string(pong) != "pong" {
+		t.Fatalf("second stream: %q, %v", pong, err)
+	}
+
+	got := make([]byte, total)
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(slow, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("data received on the slow stream differs from what was sent")
+	}
+	if n := <-written; n != total {
+		t.Fatalf("wrote %d bytes, want %d", n, total)
+	}
+}
+
+// heldConn queues its writes and only passes them on once release is closed,
+// without blocking the writer
+type heldConn struct {
+	net.Conn
+	queue chan []byte
+}
+
+func newHeldConn(conn net.Conn, release <-chan struct{}) *heldConn {
+	c := &heldConn{Conn: conn, queue: make(chan []byte, 1024)}
+	go func() {
+		<-release
+		for b := range c.queue {
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *heldConn) Write(b []byte) (int, error) {
+	c.queue <- bytes.Clone(b)
+	return len(b), nil
+}
+
+// TestUploadBeforeSettings checks that a client uploading before cmdServerSettings
+// arrives stays within the default window instead of getting its stream closed
+func TestUploadBeforeSettings(t *testing.T) {
+	const total = 2*defaultStreamWindow + recvWindowSlack
+	payload := make([]byte, total)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	release := make(chan struct{})
+	streams := make(chan *Stream, 1)
+	server := NewServerSession(newHeldConn(serverConn, release), func(stream *Stream) {
+		streams <- stream
+	}, &padding.DefaultPaddingFactory)
+	go server.Run()
+	client := NewClientSession(clientConn, &padding.DefaultPaddingFactory)
+	client.Run()
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(payload)
+		written <- err
+	}()
+
+	serverStream := <-streams
+	time.Sleep(500 * time.Millisecond)
+	if unacked := stream.sendUnacked.Load(); unacked > defaultStreamWindow {
+		t.Errorf("client sent %d bytes before the server settings, window is %d", unacked, defaultStreamWindow)
+	}
+	close(release)
+
+	got := make([]byte, total)
+	serverStream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(serverStream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("data received by the server differs from what was sent")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWindowExceeded checks that a peer ignoring the window gets its stream closed
+func TestWindowExceeded(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	streams := make(chan *Stream, 1)
+	server := NewServerSession(serverConn, func(stream *Stream) {
+		// never read
+		streams <- stream
+	}, &padding.DefaultPaddingFactory)
+	go server.Run()
+	defer server.Close()
+	defer clientConn.Close()
+
+	// the raw client sees cmdFIN for its stream once the server gives up on it
+	fin := make(chan struct{})
+	go func() {
+		var hdr [headerOverHeadSize]byte
+		for {
+			if _, err := io.ReadFull(clientConn, hdr[:]); err != nil {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, clientConn, int64(binary.BigEndian.Uint16(hdr[5:]))); err != nil {
+				return
+			}
+			if hdr[0] == cmdFIN && binary.BigEndian.Uint32(hdr[1:]) == 1 {
+				close(fin)
+				return
+			}
+		}
+	}()
+
+	writeFrame := func(cmd byte, sid uint32, data []byte) error {
+		b := []byte{cmd}
+		b = binary.BigEndian.AppendUint32(b, sid)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		_, err := clientConn.Write(append(b, data...))
+		return err
+	}
+	settings := util.StringMap{
+		"v":           strconv.Itoa(protocolVersion),
+		"padding-md5": padding.DefaultPaddingFactory.Load().Md5,
+		"window":      strconv.Itoa(defaultStreamWindow),
+	}
+	if err := writeFrame(cmdSettings, 0, settings.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(cmdSYN, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, maxDataFrameSize)
+	for sent := 0; sent <= defaultStreamWindow+recvWindowSlack; sent += len(data) {
+		if err := writeFrame(cmdPSH, 1, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream := <-streams
+	select {
+	case <-stream.die:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream still open after the peer exceeded the window")
+	}
+	if stream.dieErr != ErrWindowExceeded {
+		t.Errorf("stream closed with %v, want %v", stream.dieErr, ErrWindowExceeded)
+	}
+	select {
+	case <-fin:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no cmdFIN sent to the peer")
+	}
+	if server.IsClosed() {
+		t.Error("the whole session was closed, only the stream should be")
+	}
+}
+
+// TestPacketDelay checks that the record delays of a packet are summed and capped
+func TestPacketDelay(t *testing.T) {
+	p := padding.NewPaddingFactory([]byte("version=2\nstop=3\n1=100,c,100,c,100\n2=100,100,100,100\ndelay.1=100ms\ndelay.2=400ms"))
+	if p == nil {
+		t.Fatal("scheme does not parse")
+	}
+	tests := []struct {
+		pkt  uint32
+		size int
+		want time.Duration
+	}{
+		{1, 50, 100 * time.Millisecond},
+		{1, 150, 200 * time.Millisecond},
+		{1, 1000, 300 * time.Millisecond},
+		{2, 50, maxPacketDelay},
+	}
+	for _, tt := range tests {
+		if got := packetDelay(p, tt.pkt, p.GenerateRecordPayloadSizes(tt.pkt), tt.size); got != tt.want {
+			t.Errorf("packetDelay(%d, %d) = %v, want %v", tt.pkt, tt.size, got, tt.want)
+		}
+	}
+}
+
+// TestDelayKeepsOrder checks that frames written while a packet waits for its
+// delay, such as the cmdFIN of the same stream, are sent after it
+func TestDelayKeepsOrder(t *testing.T) {
+	var scheme atomic.TypedValue[*padding.PaddingFactory]
+	scheme.Store(padding.NewPaddingFactory([]byte("version=2\nstop=4\n1=100\n2=100\n3=100\ndelay.2=300ms")))
+
+	clientConn, serverConn := net.Pipe()
+	received := make(chan []byte, 1)
+	server := NewServerSession(serverConn, func(stream *Stream) {
+		stream.HandshakeSuccess()
+		b, _ := io.ReadAll(stream)
+		received <- b
+	}, &scheme)
+	go server.Run()
+	client := NewClientSession(clientConn, &scheme)
+	client.Run()
+	defer client.Close()
+	defer server.Close()
+
+	stream := openStream(t, client)
+	go func() {
+		// packet 3, written while packet 2 waits: the cmdFIN of stream.Close
+		time.Sleep(100 * time.Millisecond)
+		client.streamClosed(stream.id)
+	}()
+	// packet 2
+	if _, err := stream.Write([]byte("delayed")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-received:
+		if string(b) != "\x00delayed" {
+			t.Errorf("server received %q, want the delayed data before cmdFIN", b)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream not closed")
+	}
+}
@@ -0,0 +1,96 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+)
+
+// SimulatedRecord is one Write to the TLS connection made by writeConn
+type SimulatedRecord struct {
+	// Write is the index of the payload in the trace; for Upstream, -1 is the
+	// authentication packet sent before the session starts
+	Write int
+	// Packet is the padding packet number the record belongs to
+	Packet uint32
+	// Size is the TLS plaintext size, Payload + Padding
+	Size    int
+	Payload int
+	Padding int
+	// Delay is the time waited before the record was written, the whole
+	// delay of a packet is waited before its first record
+	Delay time.Duration
+}
+
+// SimulateWrites runs the writeConn splitting of scheme p in direction dir over
+// a trace of payload sizes, one writeConn call per entry, and returns the
+// records that would be written. Delays are recorded instead of slept.
+func SimulateWrites(p *padding.PaddingFactory, dir padding.Direction, trace []int) []SimulatedRecord {
+	conn := &recordingConn{}
+	paddingF := new(atomic.TypedValue[*padding.PaddingFactory])
+	paddingF.Store(p)
+	s := &Session{
+		conn:        conn,
+		isClient:    dir == padding.Upstream,
+		sendPadding: true,
+		padding:     paddingF,
+		sleep:       func(d time.Duration) { conn.delay += d },
+	}
+	if !s.isClient {
+		s.downstreamPadding = paddingF
+	}
+
+	if s.isClient {
+		// packet 0: sha256(password), padding0 length and padding0
+		var paddingLen int
+		if pad := p.GenerateRecordPayloadSizes(0); len(pad) > 0 {
+			paddingLen = pad[0]
+		}
+		conn.records = append(conn.records, SimulatedRecord{
+			Write:   -1,
+			Size:    34 + paddingLen,
+			Payload: 34,
+			Padding: paddingLen,
+		})
+	}
+
+	for i, size := range trace {
+		conn.write = i
+		conn.remaining = size
+		// every writeConn call is one packet, the client's first one is packet 1
+		conn.packet = uint32(i)
+		if s.isClient {
+			conn.packet++
+		}
+		s.writeConn(make([]byte, size))
+	}
+	return conn.records
+}
+
+// recordingConn records the size of every Write. writeConn always writes the
+// payload before the padding, so the payload part of a record is known.
+type recordingConn struct {
+	net.Conn
+	records   []SimulatedRecord
+	write     int
+	packet    uint32
+	remaining int
+	delay     time.Duration
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	payload := min(len(b), c.remaining)
+	c.remaining -= payload
+	c.records = append(c.records, SimulatedRecord{
+		Write:   c.write,
+		Packet:  c.packet,
+		Size:    len(b),
+		Payload: payload,
+		Padding: len(b) - payload,
+		Delay:   c.delay,
+	})
+	c.delay = 0
+	return len(b), nil
+}
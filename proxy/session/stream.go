@@ -6,7 +6,10 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sagernet/sing/common/buf"
 )
 
 // Stream implements net.Conn
@@ -20,10 +23,28 @@ type Stream struct {
 	writeDeadline pipe.PipeDeadline
 
 	dieOnce sync.Once
+	die     chan struct{}
 	dieHook func()
 	dieErr  error
 
 	reportOnce sync.Once
+
+	// flow control (protocol v3), receive side: recvLoop queues data here and
+	// the pump goroutine feeds it to pipeW, so a slow reader only blocks itself
+	recvLock    sync.Mutex
+	recvQueue   [][]byte // a nil entry marks cmdFIN
+	recvPumping bool
+	recvClosed  bool
+	recvSignal  chan struct{}
+	recvUnacked int
+	// recvOutstanding is what the peer has sent and we have not yet returned
+	// with cmdWindowUpdate, it must stay within our window
+	recvOutstanding int
+
+	// flow control (protocol v3), send side: bytes sent but not yet acknowledged
+	// by cmdWindowUpdate, must stay below the peer's window
+	sendUnacked atomic.Int64
+	sendSignal  chan struct{}
 }
 
 // newStream initiates a Stream struct
@@ -33,6 +54,9 @@ func newStream(id uint32, sess *Session) *Stream {
 	s.sess = sess
 	s.pipeR, s.pipeW = pipe.Pipe()
 	s.writeDeadline = pipe.MakePipeDeadline()
+	s.die = make(chan struct{})
+	s.recvSignal = make(chan struct{}, 1)
+	s.sendSignal = make(chan struct{}, 1)
 	return s
 }
 
@@ -55,10 +79,158 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 	if s.dieErr != nil {
 		return 0, s.dieErr
 	}
-	n, err = s.sess.writeDataFrame(s.id, b)
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxDataFrameSize)]
+		if s.sess.sendLimited() {
+			window, err := s.waitSendWindow()
+			if err != nil {
+				return n, err
+			}
+			chunk = chunk[:min(len(chunk), window)]
+		}
+		s.sendUnacked.Add(int64(len(chunk)))
+		nw, err := s.sess.writeDataFrame(s.id, chunk)
+		n += nw
+		if err != nil {
+			return n, err
+		}
+		b = b[len(chunk):]
+	}
 	return
 }
 
+// waitSendWindow blocks until the peer's window has room and returns how much
+func (s *Stream) waitSendWindow() (int, error) {
+	for {
+		settling := s.sess.settling()
+		if settling == nil && !s.sess.flowControl() {
+			// the server turned out not to speak v3
+			return maxDataFrameSize, nil
+		}
+		if window := s.sess.peerWindow.Load() - s.sendUnacked.Load(); window > 0 {
+			return int(min(window, maxDataFrameSize)), nil
+		}
+		select {
+		case <-s.sendSignal:
+		case <-settling:
+		case <-s.die:
+			return 0, s.dieErr
+		case <-s.writeDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// windowUpdate handles cmdWindowUpdate from the peer
+func (s *Stream) windowUpdate(n uint32) {
+	s.sendUnacked.Add(-int64(n))
+	select {
+	case s.sendSignal <- struct{}{}:
+	default:
+	}
+}
+
+// pushData queues data received in cmdPSH without blocking recvLoop.
+// It takes ownership of b, which must come from buf.Get.
+func (s *Stream) pushData(b []byte) {
+	s.recvLock.Lock()
+	if s.recvClosed {
+		s.recvLock.Unlock()
+		buf.Put(b)
+		return
+	}
+	s.recvOutstanding += len(b)
+	if s.recvOutstanding > s.sess.recvWindow+recvWindowSlack {
+		// the peer ignores our window, queueing more would let it use up our memory
+		s.recvLock.Unlock()
+		buf.Put(b)
+		s.closeWithError(ErrWindowExceeded)
+		return
+	}
+	s.recvQueue = append(s.recvQueue, b)
+	if !s.recvPumping {
+		s.recvPumping = true
+		go s.pump()
+	}
+	s.recvLock.Unlock()
+	select {
+	case s.recvSignal <- struct{}{}:
+	default:
+	}
+}
+
+// finReceived handles cmdFIN: queued data is still delivered before the stream closes
+func (s *Stream) finReceived() {
+	s.recvLock.Lock()
+	if s.recvPumping && !s.recvClosed {
+		s.recvQueue = append(s.recvQueue, nil)
+		s.recvLock.Unlock()
+		select {
+		case s.recvSignal <- struct{}{}:
+		default:
+		}
+		return
+	}
+	s.recvLock.Unlock()
+	s.closeLocally()
+}
+
+// pump feeds queued data to the reader and grants the peer a new window
+// once enough of it has been consumed
+func (s *Stream) pump() {
+	defer func() {
+		s.recvLock.Lock()
+		s.recvClosed = true
+		for _, b := range s.recvQueue {
+			if b != nil {
+				buf.Put(b)
+			}
+		}
+		s.recvQueue = nil
+		s.recvLock.Unlock()
+		// after cmdFIN the stream is no longer in the session's map, so a
+		// session closing now would not close it for us
+		s.closeLocally()
+	}()
+
+	for {
+		s.recvLock.Lock()
+		if len(s.recvQueue) == 0 {
+			s.recvLock.Unlock()
+			select {
+			case <-s.recvSignal:
+				continue
+			case <-s.die:
+				return
+			}
+		}
+		b := s.recvQueue[0]
+		s.recvQueue = s.recvQueue[1:]
+		s.recvLock.Unlock()
+
+		if b == nil {
+			return
+		}
+		_, err := s.pipeW.Write(b)
+		buf.Put(b)
+		if err != nil {
+			return
+		}
+
+		s.recvUnacked += len(b)
+		if s.recvUnacked >= s.sess.recvWindow/4 {
+			// returned before the update is sent, the peer may use it right away
+			s.recvLock.Lock()
+			s.recvOutstanding -= s.recvUnacked
+			s.recvLock.Unlock()
+			if err := s.sess.writeWindowUpdate(s.id, uint32(s.recvUnacked)); err != nil {
+				return
+			}
+			s.recvUnacked = 0
+		}
+	}
+}
+
 // Close implements net.Conn
 func (s *Stream) Close() error {
 	return s.closeWithError(io.ErrClosedPipe)
@@ -70,6 +242,7 @@ func (s *Stream) closeLocally() {
 	s.dieOnce.Do(func() {
 		s.dieErr = net.ErrClosed
 		s.pipeR.Close()
+		close(s.die)
 		once = true
 	})
 	if once {
@@ -85,6 +258,7 @@ func (s *Stream) closeWithError(err error) error {
 	s.dieOnce.Do(func() {
 		s.dieErr = err
 		s.pipeR.Close()
+		close(s.die)
 		once = true
 	})
 	if once {
@@ -138,6 +312,9 @@ func (s *Stream) HandshakeFailure(err error) error {
 	s.reportOnce.Do(func() {
 		once = true
 	})
+	if once && err != nil {
+		metricStreamOpenFailures.Inc(classifyStreamError(err.Error()))
+	}
 	if once && err != nil && s.sess.peerVersion >= 2 {
 		f := newFrame(cmdSYNACK, s.id)
 		f.data = []byte(err.Error())
@@ -0,0 +1,176 @@
+// Package route holds the destination conditions shared by the client routing
+// rules and the server outbound rules: ports, IP prefixes and domains.
+package route
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From, To uint16
+}
+
+// ParsePortRange parses 25 or 8000-9000
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	start, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	end := start
+	if isRange {
+		end, err = strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || end < start {
+			return PortRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return PortRange{From: uint16(start), To: uint16(end)}, nil
+}
+
+// Contains reports whether port is in the range
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// ParsePrefix parses a CIDR such as 10.0.0.0/8, or a single address which
+// becomes a prefix of its full length. The prefix is masked.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix.Masked(), nil
+}
+
+// NormalizeDomain returns domain in the form Matcher expects: lower case
+// without the trailing dot
+func NormalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// Matcher holds the destination conditions of a rule. A destination matches
+// when any of the domain and IP conditions matches and its port is in one of
+// the ranges; a Matcher without ports matches every port. The zero value is
+// ready to use.
+type Matcher struct {
+	domainFull    map[string]bool
+	domainSuffix  map[string]bool
+	domainKeyword []string
+	domainRegex   []*regexp.Regexp
+	ipCIDR        []netip.Prefix
+	ports         []PortRange
+}
+
+// AddDomainFull adds a domain that matches only itself
+func (m *Matcher) AddDomainFull(domain string) {
+	if m.domainFull == nil {
+		m.domainFull = make(map[string]bool)
+	}
+	m.domainFull[strings.ToLower(domain)] = true
+}
+
+// AddDomainSuffix adds a domain that matches itself and its subdomains, a
+// leading dot is ignored
+func (m *Matcher) AddDomainSuffix(suffix string) {
+	if m.domainSuffix == nil {
+		m.domainSuffix = make(map[string]bool)
+	}
+	m.domainSuffix[strings.TrimPrefix(strings.ToLower(suffix), ".")] = true
+}
+
+// AddDomainKeyword adds a string that matches the domains containing it
+func (m *Matcher) AddDomainKeyword(keyword string) {
+	m.domainKeyword = append(m.domainKeyword, strings.ToLower(keyword))
+}
+
+// AddDomainRegex adds a regular expression matched against the domain
+func (m *Matcher) AddDomainRegex(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	m.domainRegex = append(m.domainRegex, re)
+	return nil
+}
+
+// AddPrefix adds prefixes that match the addresses they contain
+func (m *Matcher) AddPrefix(prefixes ...netip.Prefix) {
+	m.ipCIDR = append(m.ipCIDR, prefixes...)
+}
+
+// AddPortRange adds a range of ports the destination port must be in
+func (m *Matcher) AddPortRange(r PortRange) {
+	m.ports = append(m.ports, r)
+}
+
+// HasDestination reports whether the matcher has domain or IP conditions;
+// without any it matches every destination.
+func (m *Matcher) HasDestination() bool {
+	return len(m.domainFull) > 0 || len(m.domainSuffix) > 0 || len(m.domainKeyword) > 0 ||
+		len(m.domainRegex) > 0 || len(m.ipCIDR) > 0
+}
+
+// HasIP reports whether the matcher has IP conditions, a domain destination
+// needs to be resolved to check them
+func (m *Matcher) HasIP() bool {
+	return len(m.ipCIDR) > 0
+}
+
+// MatchPort reports whether port is allowed
+func (m *Matcher) MatchPort(port uint16) bool {
+	return len(m.ports) == 0 || slices.ContainsFunc(m.ports, func(r PortRange) bool {
+		return r.Contains(port)
+	})
+}
+
+// MatchDomain reports whether a domain condition matches domain, which must
+// be normalized with NormalizeDomain
+func (m *Matcher) MatchDomain(domain string) bool {
+	if m.domainFull[domain] {
+		return true
+	}
+	// check the domain and each of its parents against the suffixes
+	for suffix := domain; len(m.domainSuffix) > 0; {
+		if m.domainSuffix[suffix] {
+			return true
+		}
+		_, parent, found := strings.Cut(suffix, ".")
+		if !found {
+			break
+		}
+		suffix = parent
+	}
+	for _, keyword := range m.domainKeyword {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	for _, re := range m.domainRegex {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchIP reports whether any of addresses is in one of the prefixes
+func (m *Matcher) MatchIP(addresses []netip.Addr) bool {
+	for _, addr := range addresses {
+		for _, prefix := range m.ipCIDR {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package route
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    PortRange
+		wantErr bool
+	}{
+		{"25", PortRange{25, 25}, false},
+		{"0", PortRange{0, 0}, false},
+		{"8000-9000", PortRange{8000, 9000}, false},
+		{" 80 - 443 ", PortRange{80, 443}, false},
+		{"443-443", PortRange{443, 443}, false},
+		{"65535", PortRange{65535, 65535}, false},
+		{"65536", PortRange{}, true},
+		{"-1", PortRange{}, true},
+		{"9000-8000", PortRange{}, true},
+		{"80-", PortRange{}, true},
+		{"http", PortRange{}, true},
+		{"", PortRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %v, %v, want %v, error %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{"192.168.1.1", "192.168.1.1/32", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"::1", "::1/128", false},
+		{"10.0.0.0/33", "", true},
+		{"example.com", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrefix(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePrefix(%q) error %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParsePrefix(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMatcherDomain(t *testing.T) {
+	var m Matcher
+	m.AddDomainFull("Full.example")
+	m.AddDomainSuffix(".Example.com")
+	m.AddDomainKeyword("TRACK")
+	if err := m.AddDomainRegex(`^ads?\d*\.`); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddDomainRegex(`(`); err == nil {
+		t.Error("invalid regular expression accepted")
+	}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"full.example", true},
+		{"www.full.example", false},
+		{"example.com", true},
+		{"a.b.example.com", true},
+		{"notexample.com", false},
+		{"example.com.cn", false},
+		{"tracker.net", true},
+		{"ad1.net", true},
+		{"bad.net", false},
+		{NormalizeDomain("WWW.Example.COM."), true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := m.MatchDomain(tt.domain); got != tt.want {
+			t.Errorf("MatchDomain(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+	if !m.HasDestination() || m.HasIP() {
+		t.Error("domain conditions only: HasDestination or HasIP is wrong")
+	}
+}
+
+func TestMatcherIPAndPort(t *testing.T) {
+	var m Matcher
+	if m.HasDestination() || !m.MatchPort(1) {
+		t.Error("empty matcher does not match everything")
+	}
+	m.AddPrefix(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32"))
+	m.AddPortRange(PortRange{80, 80})
+	m.AddPortRange(PortRange{8000, 9000})
+
+	ipTests := []struct {
+		addresses []string
+		want      bool
+	}{
+		{[]string{"10.1.2.3"}, true},
+		{[]string{"11.0.0.1"}, false},
+		{[]string{"11.0.0.1", "10.0.0.1"}, true},
+		{[]string{"2001:db8::1"}, true},
+		{[]string{"::ffff:10.0.0.1"}, false},
+		{nil, false},
+	}
+	for _, tt := range ipTests {
+		var addresses []netip.Addr
+		for _, s := range tt.addresses {
+			addresses = append(addresses, netip.MustParseAddr(s))
+		}
+		if got := m.MatchIP(addresses); got != tt.want {
+			t.Errorf("MatchIP(%v) = %v, want %v", tt.addresses, got, tt.want)
+		}
+	}
+
+	for port, want := range map[uint16]bool{80: true, 81: false, 7999: false, 8000: true, 8500: true, 9000: true, 9001: false} {
+		if got := m.MatchPort(port); got != want {
+			t.Errorf("MatchPort(%d) = %v, want %v", port, got, want)
+		}
+	}
+	if !m.HasIP() {
+		t.Error("HasIP = false with prefixes")
+	}
+}
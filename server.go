@@ -0,0 +1,292 @@
+package anytls
+
+import (
+	"anytls/auth"
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// Handler serves one stream. destination is where the client wants to go;
+// for UDP-over-TCP it is a udp-over-tcp.arpa address and the stream carries a
+// UoT request. The handler reports whether the outbound could be opened with
+// N.ReportHandshakeSuccess / N.ReportHandshakeFailure from sing, and the
+// stream is closed when it returns.
+type Handler func(ctx context.Context, s *Session, stream net.Conn, destination M.Socksaddr)
+
+// ServerConfig configures a Server
+type ServerConfig struct {
+	// TLSConfig is required
+	TLSConfig *tls.Config
+	// Passwords are accepted as user 0. Authenticator is used instead when set.
+	Passwords []string
+	// Authenticator checks the sha256 of the password sent by a client
+	Authenticator auth.Authenticator
+
+	// Padding is the scheme offered to clients, padding.DefaultPaddingFactory by default
+	Padding *atomic.TypedValue[*padding.PaddingFactory]
+	// DownstreamPadding makes the server pad its own traffic, nil leaves it
+	// unpadded. padding.DefaultDownstreamPaddingFactory holds the built-in scheme.
+	DownstreamPadding *atomic.TypedValue[*padding.PaddingFactory]
+
+	// HeartbeatInterval enables active keepalive of sessions silent for that long,
+	// sessions not answering within HeartbeatTimeout are closed
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// Fallback serves connections that fail authentication, they are closed when nil.
+	// The bytes already read are replayed on conn.
+	Fallback func(ctx context.Context, conn net.Conn)
+	// OnSession is called for an authenticated session before its streams are
+	// served. A non-nil error is sent to the client as an alert and ends the session.
+	OnSession func(s *Session) error
+	// OnSessionClosed is called after a session accepted by OnSession has ended
+	// and all its handlers have returned
+	OnSessionClosed func(s *Session)
+	// Handler is required
+	Handler Handler
+}
+
+// Server accepts AnyTLS connections
+type Server struct {
+	config   ServerConfig
+	listener net.Listener
+}
+
+// NewServer creates a Server for listener. listener may be nil when the
+// connections are handed over with ServeConn.
+func NewServer(listener net.Listener, config ServerConfig) (*Server, error) {
+	if config.TLSConfig == nil {
+		return nil, errors.New("anytls: TLS config is required")
+	}
+	if config.Handler == nil {
+		return nil, errors.New("anytls: handler is required")
+	}
+	if config.Authenticator == nil {
+		if len(config.Passwords) == 0 {
+			return nil, errors.New("anytls: passwords or an authenticator is required")
+		}
+		config.Authenticator = auth.NewPasswords(config.Passwords...)
+	}
+	if config.Padding == nil {
+		config.Padding = &padding.DefaultPaddingFactory
+	}
+	return &Server{
+		config:   config,
+		listener: listener,
+	}, nil
+}
+
+// Listen listens on the network address and creates a Server for it
+func Listen(network, address string, config ServerConfig) (*Server, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewServer(listener, config)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Serve accepts connections until the listener is closed, then returns nil
+func (s *Server) Serve() error {
+	if s.listener == nil {
+		return errors.New("anytls: server has no listener")
+	}
+	ctx := context.Background()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(ctx, c)
+	}
+}
+
+// Addr returns the listener's address
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close closes the listener. Sessions already established are not affected.
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// ServeConn serves one accepted TCP connection until it is closed:
+// TLS handshake, authentication, then the streams of the session.
+func (s *Server) ServeConn(ctx context.Context, c net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorln("[BUG]", r, string(debug.Stack()))
+		}
+	}()
+
+	c = tls.Server(c, s.config.TLSConfig)
+	defer c.Close()
+
+	// the first packet carries the authentication
+	b := buf.NewPacket()
+	defer b.Release()
+
+	n, err := b.ReadOnceFrom(c)
+	if err != nil {
+		logrus.Debugln("ReadOnceFrom:", err)
+		return
+	}
+	c = bufio.NewCachedConn(c, b)
+
+	fallback := func() {
+		b.Resize(0, n)
+		if s.config.Fallback != nil {
+			s.config.Fallback(ctx, c)
+		}
+	}
+
+	passwordHashBytes, err := b.ReadBytes(32)
+	if err != nil {
+		fallback()
+		return
+	}
+	user, ok := s.config.Authenticator.Authenticate(passwordHashBytes)
+	if !ok {
+		fallback()
+		return
+	}
+
+	paddingLenBytes, err := b.ReadBytes(2)
+	if err != nil {
+		fallback()
+		return
+	}
+	paddingLen := binary.BigEndian.Uint16(paddingLenBytes)
+	if paddingLen > 0 {
+		if _, err = b.ReadBytes(int(paddingLen)); err != nil {
+			fallback()
+			return
+		}
+	}
+
+	sess := &Session{
+		User:       user,
+		RemoteAddr: c.RemoteAddr(),
+	}
+	sess.sess = session.NewServerSession(c, func(stream *session.Stream) {
+		s.serveStream(ctx, sess, stream)
+	}, s.config.Padding)
+
+	if s.config.OnSession != nil {
+		if err := s.config.OnSession(sess); err != nil {
+			sess.sess.Alert(err.Error())
+			return
+		}
+	}
+
+	sess.sess.SetHeartbeat(s.config.HeartbeatInterval, s.config.HeartbeatTimeout)
+	sess.sess.SetDownstreamPadding(s.config.DownstreamPadding)
+
+	sess.sess.Run()
+	sess.sess.Close()
+	sess.waitHandlers()
+
+	if s.config.OnSessionClosed != nil {
+		s.config.OnSessionClosed(sess)
+	}
+}
+
+func (s *Server) serveStream(ctx context.Context, sess *Session, stream *session.Stream) {
+	if !sess.startHandler() {
+		stream.Close()
+		return
+	}
+	defer sess.handlers.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorln("[BUG]", r, string(debug.Stack()))
+		}
+	}()
+	defer stream.Close()
+
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(stream)
+	if err != nil {
+		logrus.Debugln("ReadAddrPort:", err)
+		return
+	}
+	s.config.Handler(ctx, sess, stream, destination)
+}
+
+// Session is an authenticated client session on the server
+type Session struct {
+	// User is who the Authenticator resolved the password to
+	User       auth.User
+	RemoteAddr net.Addr
+	// Value is free for OnSession to attach per-session state
+	Value any
+
+	sess *session.Session
+
+	// handlers tracks the running stream handlers, OnSessionClosed waits for them
+	handlersMu     sync.Mutex
+	handlersClosed bool
+	handlers       sync.WaitGroup
+}
+
+// GoAway asks the client to stop opening streams on this session, which is
+// closed once its last stream is gone
+func (s *Session) GoAway() error {
+	return s.sess.GoAway()
+}
+
+// Alert sends message to the client and closes the session
+func (s *Session) Alert(message string) error {
+	return s.sess.Alert(message)
+}
+
+// Close closes the session and all its streams
+func (s *Session) Close() error {
+	return s.sess.Close()
+}
+
+// StreamCount returns the number of open streams
+func (s *Session) StreamCount() int {
+	return s.sess.StreamCount()
+}
+
+func (s *Session) startHandler() bool {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	if s.handlersClosed {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Session) waitHandlers() {
+	s.handlersMu.Lock()
+	s.handlersClosed = true
+	s.handlersMu.Unlock()
+	s.handlers.Wait()
+}
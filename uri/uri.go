@@ -0,0 +1,198 @@
+// Package uri parses and formats anytls:// share links as described in
+// docs/uri_scheme.md:
+//
+//	anytls://[auth@]hostname[:port]/?[key=value]&[key=value]...
+//
+// Besides sni and insecure it knows the pin-sha256 and padding extension
+// parameters of this implementation. Other parameters are kept in Extra.
+package uri
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Scheme is the URI scheme of AnyTLS links
+	Scheme = "anytls"
+	// DefaultPort is used when a link has no port
+	DefaultPort = 443
+)
+
+// Query parameters
+const (
+	paramSNI       = "sni"
+	paramInsecure  = "insecure"
+	paramPinSHA256 = "pin-sha256"
+	paramPadding   = "padding"
+)
+
+// URI is a parsed anytls:// link
+type URI struct {
+	// Password is the auth part, percent-decoded
+	Password string
+	// Host is a hostname or an IP address, without brackets
+	Host string
+	Port uint16
+	// SNI is the TLS server name; an IP address means no SNI is sent
+	SNI string
+	// Insecure skips the verification of the server certificate
+	Insecure bool
+	// PinSHA256 are SHA-256 hashes of the server leaf certificate or of its
+	// public key (SPKI), formatted as lowercase hex in links
+	PinSHA256 [][]byte
+	// Padding is the initial padding scheme, base64url encoded in links
+	Padding []byte
+	// Name is the fragment, usually a label for the server
+	Name string
+	// Extra are the parameters not known to this package
+	Extra url.Values
+}
+
+// IsURI reports whether s looks like an anytls:// link rather than host:port
+func IsURI(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), Scheme+"://")
+}
+
+// Parse parses an anytls:// link
+func Parse(s string) (*URI, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != Scheme {
+		return nil, fmt.Errorf("scheme must be %s, got %q", Scheme, u.Scheme)
+	}
+	if u.Opaque != "" || (u.Path != "" && u.Path != "/") {
+		return nil, errors.New("unexpected path")
+	}
+
+	result := &URI{
+		Host: u.Hostname(),
+		Port: DefaultPort,
+		Name: u.Fragment,
+	}
+	if result.Host == "" {
+		return nil, errors.New("missing hostname")
+	}
+	if port := u.Port(); port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		result.Port = uint16(n)
+	}
+	if u.User != nil {
+		// a colon in the auth part is not a separator, it belongs to the password
+		result.Password = u.User.Username()
+		if password, set := u.User.Password(); set {
+			result.Password += ":" + password
+		}
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case paramSNI:
+			result.SNI = value
+		case paramInsecure:
+			switch value {
+			case "1", "true":
+				result.Insecure = true
+			case "0", "false":
+			default:
+				return nil, fmt.Errorf("%s: expected 1 or 0, got %q", key, value)
+			}
+		case paramPinSHA256:
+			for _, value := range values {
+				for _, pin := range strings.Split(value, ",") {
+					hash, err := ParsePin(pin)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", key, err)
+					}
+					result.PinSHA256 = append(result.PinSHA256, hash)
+				}
+			}
+		case paramPadding:
+			scheme, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			result.Padding = scheme
+		default:
+			if result.Extra == nil {
+				result.Extra = make(url.Values)
+			}
+			result.Extra[key] = values
+		}
+	}
+	return result, nil
+}
+
+// ParsePin parses a SHA-256 hash given as hex, optionally with colons as
+// printed by openssl, or as standard base64 as used by HPKP
+func ParsePin(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if hash, err := hex.DecodeString(strings.ReplaceAll(s, ":", "")); err == nil && len(hash) == 32 {
+		return hash, nil
+	}
+	if hash, err := base64.StdEncoding.DecodeString(s); err == nil && len(hash) == 32 {
+		return hash, nil
+	}
+	return nil, fmt.Errorf("invalid SHA-256 hash %q", s)
+}
+
+// Address returns host:port for dialing
+func (u *URI) Address() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(int(u.Port)))
+}
+
+// String formats the link. The port is always included.
+func (u *URI) String() string {
+	query := make(url.Values)
+	for key, values := range u.Extra {
+		query[key] = values
+	}
+	if u.SNI != "" {
+		query.Set(paramSNI, u.SNI)
+	}
+	if u.Insecure {
+		query.Set(paramInsecure, "1")
+	}
+	if len(u.PinSHA256) > 0 {
+		pins := make([]string, 0, len(u.PinSHA256))
+		for _, hash := range u.PinSHA256 {
+			pins = append(pins, hex.EncodeToString(hash))
+		}
+		query.Set(paramPinSHA256, strings.Join(pins, ","))
+	}
+	if len(u.Padding) > 0 {
+		query.Set(paramPadding, base64.RawURLEncoding.EncodeToString(u.Padding))
+	}
+
+	port := u.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	link := url.URL{
+		Scheme:   Scheme,
+		Host:     net.JoinHostPort(u.Host, strconv.Itoa(int(port))),
+		Path:     "/",
+		RawQuery: query.Encode(),
+		Fragment: u.Name,
+	}
+	if u.Password != "" {
+		link.User = url.User(u.Password)
+	}
+	return link.String()
+}
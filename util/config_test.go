@@ -0,0 +1,42 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	type config struct {
+		Listen string `yaml:"listen" json:"listen"`
+	}
+	tests := []struct {
+		name, content string
+		want          string
+		wantErr       bool
+	}{
+		{"c.yaml", "listen: :8443\n", ":8443", false},
+		{"empty.yaml", "", "default", false},
+		{"comments.yml", "# nothing set yet\n\n", "default", false},
+		{"unknown.yaml", "listne: :8443\n", "", true},
+		{"c.json", `{"listen": ":8443"}`, ":8443", false},
+		{"empty.json", "", "", true},
+		{"c.toml", "listen = ':8443'", "", true},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c := config{Listen: "default"}
+		err := LoadConfigFile(path, &c)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && c.Listen != tt.want {
+			t.Errorf("%s: listen = %q, want %q", tt.name, c.Listen, tt.want)
+		}
+	}
+}
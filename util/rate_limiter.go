@@ -0,0 +1,132 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket. A rate of 0 means unlimited.
+// The rate can be changed at any time and applies to all waiters immediately.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	// filled counts every token added so far, a waiter in debt returns once
+	// filled covers the debt it saw in WaitN
+	filled float64
+	last   time.Time
+	// changed is closed and replaced by SetRate to wake the waiters
+	changed chan struct{}
+}
+
+const minRateLimiterBurst = 64 * 1024
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	l := &RateLimiter{changed: make(chan struct{})}
+	l.SetRate(bytesPerSecond)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate changes the rate, the burst is one second worth of tokens.
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	if float64(bytesPerSecond) == l.rate {
+		return
+	}
+	// tokens up to now accrue at the old rate
+	l.refill(time.Now())
+	l.rate = float64(bytesPerSecond)
+	l.burst = max(l.rate, minRateLimiterBurst)
+	l.tokens = min(l.tokens, l.burst)
+	if l.rate == 0 {
+		// waiters return right away, their debt must not carry over to a later limit
+		l.tokens = l.burst
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// refill adds the tokens accrued since the last call, l.mu must be held
+func (l *RateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		added := now.Sub(l.last).Seconds() * l.rate
+		l.filled += added
+		l.tokens = min(l.burst, l.tokens+added)
+	}
+	l.last = now
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// WaitN takes n tokens, blocking until they are available or ctx is done.
+// Tokens may go into debt so that a single large read is not starved.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	target := l.filled - l.tokens
+
+	for {
+		// the wait is recomputed whenever SetRate changes the rate
+		if l.rate == 0 || l.filled >= target {
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((target - l.filled) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-changed:
+			t.Stop()
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		l.mu.Lock()
+		l.refill(time.Now())
+	}
+}
+
+// SpeedLimiter limits both directions of one user's traffic.
+// It is shared by all sessions and streams of that user.
+type SpeedLimiter struct {
+	Upload   *RateLimiter
+	Download *RateLimiter
+}
+
+func NewSpeedLimiter(bytesPerSecond int64) *SpeedLimiter {
+	return &SpeedLimiter{
+		Upload:   NewRateLimiter(bytesPerSecond),
+		Download: NewRateLimiter(bytesPerSecond),
+	}
+}
+
+func (l *SpeedLimiter) SetRate(bytesPerSecond int64) {
+	l.Upload.SetRate(bytesPerSecond)
+	l.Download.SetRate(bytesPerSecond)
+}
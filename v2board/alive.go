@@ -0,0 +1,113 @@
+// Package v2board 在线 IP 统计、设备数限制与定时上报
+// 按用户 ID 追踪当前在线的客户端 IP，并以可配置周期上报给 V2board 面板。
+package v2board
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AliveManager 追踪各用户的在线 IP，执行设备数限制并定期上报
+type AliveManager struct {
+	client *Client
+	auth   *AuthManager
+
+	// mu 保护 online
+	mu     sync.Mutex
+	online map[int]map[string]int // key: userID -> IP -> 该 IP 上的活跃会话数
+}
+
+// NewAliveManager 创建在线 IP 管理器，设备数上限从 auth 的用户表中读取
+func NewAliveManager(client *Client, auth *AuthManager) *AliveManager {
+	return &AliveManager{
+		client: client,
+		auth:   auth,
+		online: make(map[int]map[string]int),
+	}
+}
+
+// Acquire 登记用户在某个 IP 上的一个新会话。
+// 若该 IP 尚未在线且用户在线 IP 数已达到 device_limit，则拒绝并返回 ok=false；
+// 否则返回 release，会话结束时必须调用一次。
+func (m *AliveManager) Acquire(userID int, ip string) (release func(), ok bool) {
+	limit := 0
+	if user, exists := m.auth.GetUserByID(userID); exists && user.DeviceLimit != nil {
+		limit = *user.DeviceLimit
+	}
+
+	m.mu.Lock()
+	ips, exists := m.online[userID]
+	if !exists {
+		ips = make(map[string]int)
+		m.online[userID] = ips
+	}
+	if _, isOnline := ips[ip]; !isOnline && limit > 0 && len(ips) >= limit {
+		m.mu.Unlock()
+		return nil, false
+	}
+	ips[ip]++
+	m.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if ips, exists := m.online[userID]; exists {
+				if ips[ip]--; ips[ip] <= 0 {
+					delete(ips, ip)
+				}
+				if len(ips) == 0 {
+					delete(m.online, userID)
+				}
+			}
+		})
+	}, true
+}
+
+// OnlineIPCount 返回用户当前的在线 IP 数
+func (m *AliveManager) OnlineIPCount(userID int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.online[userID])
+}
+
+// Start 以 interval 为周期定期上报在线 IP。
+// 该方法应在 goroutine 中调用。
+func (m *AliveManager) Start(interval time.Duration) {
+	logrus.Infof("[V2board] 在线 IP 上报服务已启动，周期: %v", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.push()
+	}
+}
+
+// push 收集当前在线 IP 快照并上报
+func (m *AliveManager) push() {
+	m.mu.Lock()
+	alive := make(map[int][]string, len(m.online))
+	for userID, ips := range m.online {
+		list := make([]string, 0, len(ips))
+		for ip := range ips {
+			list = append(list, ip)
+		}
+		alive[userID] = list
+	}
+	m.mu.Unlock()
+
+	if len(alive) == 0 {
+		return
+	}
+
+	if err := m.client.PushAlive(alive); err != nil {
+		logrus.Errorf("[V2board] 在线 IP 上报失败: %v", err)
+		return
+	}
+
+	logrus.Debugf("[V2board] 在线 IP 上报成功，共 %d 个用户", len(alive))
+}
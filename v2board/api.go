@@ -68,7 +68,9 @@ type NodeInfo struct {
 }
 
 // GetNodeInfo 从 V2board 面板拉取当前节点的配置信息
-func (c *Client) GetNodeInfo() (*NodeInfo, error) {
+func (c *Client) GetNodeInfo() (_ *NodeInfo, err error) {
+	defer observeRequest("config", time.Now(), &err)
+
 	apiURL := c.buildURL("/api/v1/server/UniProxy/config")
 	resp, err := c.httpClient.Get(apiURL)
 	if err != nil {
@@ -103,6 +105,8 @@ type User struct {
 	UUID string `json:"uuid"`
 	// SpeedLimit 是用户的速度限制（Mbps），nil 表示不限速
 	SpeedLimit *uint32 `json:"speed_limit"`
+	// DeviceLimit 是用户的在线设备（IP）数限制，nil 或 0 表示不限制
+	DeviceLimit *int `json:"device_limit"`
 }
 
 // userListResponse 是用户列表 API 的响应体结构
@@ -111,7 +115,9 @@ type userListResponse struct {
 }
 
 // GetUserList 从 V2board 面板获取当前节点的有效用户列表
-func (c *Client) GetUserList() ([]User, error) {
+func (c *Client) GetUserList() (_ []User, err error) {
+	defer observeRequest("user", time.Now(), &err)
+
 	apiURL := c.buildURL("/api/v1/server/UniProxy/user")
 	resp, err := c.httpClient.Get(apiURL)
 	if err != nil {
@@ -145,10 +151,11 @@ type TrafficRecord struct {
 
 // PushTraffic 将用户流量数据上报给 V2board 面板
 // records 中应只包含流量不为零的用户记录
-func (c *Client) PushTraffic(records []TrafficRecord) error {
+func (c *Client) PushTraffic(records []TrafficRecord) (err error) {
 	if len(records) == 0 {
 		return nil
 	}
+	defer observeRequest("push", time.Now(), &err)
 
 	payload := make(map[int][2]int64, len(records))
 	for _, record := range records {
@@ -174,3 +181,40 @@ func (c *Client) PushTraffic(records []TrafficRecord) error {
 
 	return nil
 }
+
+// ---- 在线 IP 上报 ----
+
+// PushAlive 将各用户当前的在线 IP 上报给 V2board 面板。
+// alive 的 key 为用户 ID，value 为该用户在本节点的在线 IP 列表。
+func (c *Client) PushAlive(alive map[int][]string) (err error) {
+	defer observeRequest("alive", time.Now(), &err)
+
+	// 面板按 "ip_节点ID" 区分不同节点上报的同一 IP
+	payload := make(map[int][]string, len(alive))
+	for userID, ips := range alive {
+		entries := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			entries = append(entries, ip+"_"+strconv.Itoa(int(c.nodeID)))
+		}
+		payload[userID] = entries
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("序列化在线 IP 失败: %w", err)
+	}
+
+	apiURL := c.buildURL("/api/v1/server/UniProxy/alive")
+	resp, err := c.httpClient.Post(apiURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("上报在线 IP 失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("在线 IP 上报 API 返回非 200 状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@
 package v2board
 
 import (
+	"anytls/auth"
+	"anytls/util"
 	"crypto/sha256"
 	"fmt"
 	"sync"
@@ -21,10 +23,14 @@ type userEntry struct {
 type AuthManager struct {
 	client *Client
 
-	// mu 保护 usersByHash 和 usersById
+	// mu 保护 usersByHash、usersById 和 limiters
 	mu          sync.RWMutex
 	usersByHash map[[sha256.Size]byte]*userEntry // key: sha256(uuid)
 	usersById   map[int]*userEntry               // key: user.ID
+	limiters    map[int]*util.SpeedLimiter       // key: user.ID，同一用户的所有会话共享
+
+	// onUsersRemoved 在刷新后有用户被移出用户表时调用
+	onUsersRemoved func(userIDs []int)
 }
 
 // NewAuthManager 创建认证管理器，但不启动自动刷新
@@ -33,6 +39,7 @@ func NewAuthManager(client *Client) *AuthManager {
 		client:      client,
 		usersByHash: make(map[[sha256.Size]byte]*userEntry),
 		usersById:   make(map[int]*userEntry),
+		limiters:    make(map[int]*util.SpeedLimiter),
 	}
 }
 
@@ -42,7 +49,7 @@ func (m *AuthManager) Start(pullInterval time.Duration) {
 	logrus.Infof("[V2board] 用户列表自动更新已启动，周期: %v", pullInterval)
 
 	// 立即执行第一次
-	if err := m.refresh(); err != nil {
+	if err := m.Refresh(); err != nil {
 		logrus.Errorf("[V2board] 首次拉取用户列表失败: %v", err)
 	}
 
@@ -50,14 +57,21 @@ func (m *AuthManager) Start(pullInterval time.Duration) {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		if err := m.refresh(); err != nil {
+		if err := m.Refresh(); err != nil {
 			logrus.Errorf("[V2board] 刷新用户列表失败: %v", err)
 		}
 	}
 }
 
-// refresh 从 V2board API 拉取最新用户列表并更新内存表
-func (m *AuthManager) refresh() error {
+// OnUsersRemoved 设置回调：每次刷新后，若有用户不再出现在面板用户表中（过期、封禁等），
+// 则以这些用户的 ID 调用 hook。应在 Start 之前设置。
+func (m *AuthManager) OnUsersRemoved(hook func(userIDs []int)) {
+	m.onUsersRemoved = hook
+}
+
+// Refresh 从 V2board API 拉取最新用户列表并更新内存表。
+// 除 Start 的定时调用外，也可由管理接口手动触发。
+func (m *AuthManager) Refresh() error {
 	users, err := m.client.GetUserList()
 	if err != nil {
 		return fmt.Errorf("拉取用户列表: %w", err)
@@ -78,10 +92,35 @@ func (m *AuthManager) refresh() error {
 	}
 
 	m.mu.Lock()
+	// 复用已有的限速器，使正在进行的连接立即按新限速生效
+	newLimiters := make(map[int]*util.SpeedLimiter, len(users))
+	for id, entry := range newById {
+		rate := speedLimitBytesPerSecond(entry.user.SpeedLimit)
+		if limiter, exists := m.limiters[id]; exists {
+			limiter.SetRate(rate)
+			newLimiters[id] = limiter
+		} else {
+			newLimiters[id] = util.NewSpeedLimiter(rate)
+		}
+	}
+	var removed []int
+	for id := range m.usersById {
+		if _, exists := newById[id]; !exists {
+			removed = append(removed, id)
+		}
+	}
 	m.usersByHash = newByHash
 	m.usersById = newById
+	m.limiters = newLimiters
 	m.mu.Unlock()
 
+	if len(removed) > 0 {
+		logrus.Infof("[V2board] %d 个用户已被移出用户表", len(removed))
+		if m.onUsersRemoved != nil {
+			m.onUsersRemoved(removed)
+		}
+	}
+
 	logrus.Debugf("[V2board] 用户列表已更新，共 %d 个用户", len(users))
 	return nil
 }
@@ -107,6 +146,15 @@ func (m *AuthManager) CheckAuth(passwordHash []byte) (userID int, ok bool) {
 	return entry.user.ID, true
 }
 
+// Authenticate 实现 auth.Authenticator，面板用户没有名称，Name 为空
+func (m *AuthManager) Authenticate(passwordHash []byte) (auth.User, bool) {
+	userID, ok := m.CheckAuth(passwordHash)
+	if !ok {
+		return auth.User{}, false
+	}
+	return auth.User{ID: userID}, true
+}
+
 // GetUserByID 按用户 ID 查询用户信息（流量上报时使用）
 func (m *AuthManager) GetUserByID(userID int) (*User, bool) {
 	m.mu.RLock()
@@ -120,6 +168,22 @@ func (m *AuthManager) GetUserByID(userID int) (*User, bool) {
 	return &u, true
 }
 
+// SpeedLimiter 返回用户的限速器，用户不存在时返回 nil。
+// 面板未设置限速的用户也会返回一个不限速的限速器，以便之后面板调整限速时立即生效。
+func (m *AuthManager) SpeedLimiter(userID int) *util.SpeedLimiter {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.limiters[userID]
+}
+
+// speedLimitBytesPerSecond 将面板的 speed_limit（Mbps）换算为字节每秒，0 表示不限速
+func speedLimitBytesPerSecond(speedLimit *uint32) int64 {
+	if speedLimit == nil {
+		return 0
+	}
+	return int64(*speedLimit) * 1000 * 1000 / 8
+}
+
 // UserCount 返回当前缓存的用户数量
 func (m *AuthManager) UserCount() int {
 	m.mu.RLock()
@@ -0,0 +1,20 @@
+// Package v2board 面板 API 请求的监控指标
+package v2board
+
+import (
+	"anytls/metrics"
+	"time"
+)
+
+var (
+	metricRequestDuration = metrics.NewSummaryVec("anytls_v2board_request_duration_seconds", "V2board API request latency.", "api")
+	metricRequestErrors   = metrics.NewCounterVec("anytls_v2board_request_errors_total", "V2board API request errors.", "api")
+)
+
+// observeRequest 记录一次 API 请求的耗时与结果，用法：defer observeRequest("user", time.Now(), &err)
+func observeRequest(api string, start time.Time, err *error) {
+	metricRequestDuration.Observe(time.Since(start).Seconds(), api)
+	if *err != nil {
+		metricRequestErrors.Inc(api)
+	}
+}
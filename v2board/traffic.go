@@ -73,12 +73,13 @@ func (m *TrafficManager) Start(pushInterval time.Duration) {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		m.push()
+		_ = m.Push()
 	}
 }
 
-// push 收集当前所有用户的流量数据，上报后清零计数器
-func (m *TrafficManager) push() {
+// Push 收集当前所有用户的流量数据，上报后清零计数器。
+// 除 Start 的定时调用外，也可由管理接口或退出流程手动触发。
+func (m *TrafficManager) Push() error {
 	// 收集快照并清零
 	// 注意：先 Swap 再上报，防止上报失败时丢失数据；
 	// 这里选择简单策略：上报失败时本轮数据丢弃，避免重复计费。
@@ -99,7 +100,7 @@ func (m *TrafficManager) push() {
 	m.mu.RUnlock()
 
 	if len(records) == 0 {
-		return
+		return nil
 	}
 
 	if err := m.client.PushTraffic(records); err != nil {
@@ -113,8 +114,9 @@ func (m *TrafficManager) push() {
 			}
 		}
 		m.mu.RUnlock()
-		return
+		return err
 	}
 
 	logrus.Infof("[V2board] 流量上报成功，共 %d 个用户", len(records))
+	return nil
 }